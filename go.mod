@@ -2,10 +2,13 @@ module main
 
 go 1.20
 
-require github.com/ecies/go/v2 v2.0.7
+require (
+	github.com/ecies/go/v2 v2.0.7
+	golang.org/x/crypto v0.11.0
+)
 
 require (
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.2.0 // indirect
 	github.com/ethereum/go-ethereum v1.12.0 // indirect
-	golang.org/x/crypto v0.11.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
 )
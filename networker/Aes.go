@@ -9,6 +9,9 @@ import (
 	"errors"
 )
 
+// ErrFrameAuthFailed 认证加密的数据帧校验失败（被篡改或密钥不符）
+var ErrFrameAuthFailed = errors.New("frame authentication failed")
+
 //加密过程：
 //  1、处理数据，对数据进行填充，采用PKCS7（当密钥长度不够时，缺几位补几个几）的方式。
 //  2、对数据进行加密，采用AES加密方法中CBC加密模式
@@ -36,6 +39,9 @@ func pkcs7UnPadding(data []byte) ([]byte, error) {
 	}
 	//获取填充的个数
 	unPadding := int(data[length-1])
+	if unPadding <= 0 || unPadding > length {
+		return nil, errors.New("填充数据错误！")
+	}
 	return data[:(length - unPadding)], nil
 }
 
@@ -104,13 +110,64 @@ func RandomDecrypt(data []byte, key []byte) ([]byte, error) {
 	if nil != error {
 		return nil, error
 	}
+	if len(allData) < 8 {
+		return nil, errors.New("随机数据长度错误！")
+	}
 
 	return allData[4 : len(allData)-4], error
 }
 
+// AesGcmEncrypt AES-GCM认证加密，每次生成随机nonce
+// 输出格式：nonce(12字节) + 密文 + tag(16字节)
+func AesGcmEncrypt(data []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err = rand.Read(out); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(out, out, data, nil), nil
+}
+
+// AesGcmDecrypt AES-GCM解密并校验，校验失败返回 ErrFrameAuthFailed
+func AesGcmDecrypt(data []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrFrameAuthFailed
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrFrameAuthFailed
+	}
+
+	return plain, nil
+}
+
 // 生成一个随机密钥
 func newAesKey() []byte {
-	data := make([]byte, 16)
+	return newAesKeyLen(16)
+}
+
+// 生成指定长度的随机密钥
+func newAesKeyLen(keyLen int) []byte {
+	data := make([]byte, keyLen)
 	rand.Read(data)
 
 	return data
@@ -9,8 +9,10 @@ type CmdType uint16
 
 // 命令大分类（13比特位）
 const (
-	Cmd_Basic = 0
-	Cmd_User  = 1
+	Cmd_Basic    = 0
+	Cmd_User     = 1
+	Cmd_Security = 2
+	Cmd_Stream   = 3
 )
 
 // 命令细分类（3比特位）
@@ -24,6 +26,15 @@ const (
 	Cmd_SaveUser   = Cmd_User << 3
 	Cmd_DeleteUser = Cmd_SaveUser + 1
 	Cmd_QueryUser  = Cmd_SaveUser + 2
+
+	Cmd_ScramChallenge = Cmd_Security << 3
+	Cmd_Rekey          = Cmd_ScramChallenge + 1
+	Cmd_PskHello       = Cmd_ScramChallenge + 2
+	Cmd_CipherSuite    = Cmd_ScramChallenge + 3
+
+	Cmd_StreamOpen = Cmd_Stream << 3
+	Cmd_StreamData = Cmd_StreamOpen + 1
+	Cmd_StreamAck  = Cmd_StreamOpen + 2
 )
 
 type AesCmd struct {
@@ -31,6 +42,10 @@ type AesCmd struct {
 	Data any    `json:"data"`
 	IsOK bool   `json:"isok"`
 	Msg  string `json:"msg"`
+
+	Reason string `json:"reason,omitempty"` //失败原因代码，如认证被拒绝的 AuthReason
+
+	Ext *HandshakeExt `json:"ext,omitempty"`
 }
 
 func (cmd *AesCmd) ToJson() string {
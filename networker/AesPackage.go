@@ -27,42 +27,123 @@ SOFTWARE.
 package networker
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
+// JSON段长度：2字节，协商了 Cap_LargeJson 时长度不小于0xFFFE的JSON段写入0xFFFF，其后为4字节实际长度；
+// 协商了 Cap_Compress 时压缩的JSON段写入0xFFFE，其后为4字节实际长度
+const (
+	jsonLenEscape     = 0xFFFF
+	jsonLenCompressed = 0xFFFE
+)
+
+// ErrLargeJsonUnsupported 对端不支持超过64KB的JSON段
+var ErrLargeJsonUnsupported = errors.New("json segment exceeds 64KB and peer does not support large json")
+
 type AesPackage struct {
 	PacSN   uint16
 	Cmd     uint16
 	Json    string
 	ExtData []byte
+	CorrID  uint32 //收到的请求的关联ID，ReplyJson 回复时带回，未协商关联ID时为0
 }
 
 func (pkg *AesPackage) ToAesStream(aesKey []byte) []byte {
+	return pkg.ToAesStreamWithMode(aesKey, Cipher_AesCbc)
+}
+
+// ToAesStreamWithMode 按指定加密模式打包
+func (pkg *AesPackage) ToAesStreamWithMode(aesKey []byte, mode CipherMode) []byte {
+	stream, err := pkg.encode(frameCodec{mode: mode}, &frameState{key: aesKey})
+	if nil != err {
+		fmt.Println("AesPackage.ToAesStream 打包异常", err)
+		return nil
+	}
+
+	return stream
+}
+
+func (pkg *AesPackage) encode(codec frameCodec, st *frameState) ([]byte, error) {
 	//包格式：2字节(cmd+Json)长度(小端结尾) 2字节cmd(小端结尾) + + Json数据 + ExtData
+	//协商了ExtData加密时，ExtData按块加密并与前面的cmd+Json密文绑定
+	//协商了防重放序号时，cmd前加8字节发送序号一起加密
+	//协商了密钥更换时，cmd+Json密文前加1字节密钥代号（计入长度）
+	//协商了 Cap_LargeJson 时，长度不小于0xFFFF的(cmd+Json)长度写为0xFFFF + 4字节实际长度；对端不支持时返回 ErrLargeJsonUnsupported
+	//协商了 Cap_Compress 时，cmd+Json在加密前压缩，长度写为0xFFFE + 4字节实际长度
+
+	aesKey := st.key
+
+	body := make([]byte, 0, 2+len(pkg.Json))
+	body = append(body, byte(pkg.Cmd>>8), byte(pkg.Cmd))
+	body = append(body, []byte(pkg.Json)...)
+	st.bodyLen = len(body)
+
+	compressed := false
+	if st.compressMin > 0 && len(body) >= st.compressMin {
+		if zipped := deflateBody(body); nil != zipped {
+			body = zipped
+			compressed = true
+		}
+	}
+	st.wireLen = len(body)
 
-	buf := []byte{byte(pkg.Cmd >> 8), byte(pkg.Cmd)}
-	buf = append(buf, []byte(pkg.Json)...)
+	buf := make([]byte, 0, 8+len(body))
+	if codec.seq && len(aesKey) > 0 {
+		buf = binary.BigEndian.AppendUint64(buf, st.seq)
+	}
+	buf = append(buf, body...)
 
 	if len(aesKey) > 0 {
-		enc, err := RandomEncrypt(buf, aesKey)
+		enc, err := encryptByMode(codec.mode, buf, aesKey)
 		if nil != err {
-			fmt.Println("FurisonPackage.ToAesStream 加密Json异常", err)
-			return nil
+			return nil, err
 		}
 
 		buf = enc
+
+		if codec.rekey {
+			buf = append([]byte{st.epoch}, buf...)
+		}
 	}
 
 	bufLen := len(buf)
+	largeJson := codec.caps.Has(Cap_LargeJson)
+	if bufLen >= jsonLenEscape && !largeJson {
+		return nil, ErrLargeJsonUnsupported
+	}
+	encExt := codec.extEnc && len(aesKey) > 0
 
-	flag := make([]byte, 2)
-	flag[0] = byte(bufLen >> 8)
-	flag[1] = byte(bufLen)
+	extLen := len(pkg.ExtData)
+	if encExt {
+		extLen = sealedExtDataLen(extLen)
+	}
+
+	flag := make([]byte, 0, 6+bufLen+extLen)
+	if compressed {
+		flag = binary.BigEndian.AppendUint16(flag, jsonLenCompressed)
+		flag = binary.BigEndian.AppendUint32(flag, uint32(bufLen))
+	} else if bufLen >= jsonLenCompressed && largeJson {
+		flag = binary.BigEndian.AppendUint16(flag, jsonLenEscape)
+		flag = binary.BigEndian.AppendUint32(flag, uint32(bufLen))
+	} else {
+		flag = binary.BigEndian.AppendUint16(flag, uint16(bufLen))
+	}
 
 	flag = append(flag, buf...)
-	flag = append(flag, pkg.ExtData...)
 
-	return flag
+	if encExt {
+		var err error
+		flag, err = sealExtData(flag, pkg.ExtData, codec.mode, aesKey, buf)
+		if nil != err {
+			return nil, err
+		}
+	} else {
+		flag = append(flag, pkg.ExtData...)
+	}
+
+	return flag, nil
 }
 
 func (pac *AesPackage) SetPacSN(val int) {
@@ -0,0 +1,105 @@
+package networker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testCodecClient 使用指定帧编码参数和密钥的连接，只用于打包解包
+func testCodecClient(codec frameCodec, key []byte) *AesTcpClient {
+	tcp := NewAesTcpClient()
+	tcp.codec = codec
+	tcp.setSessionKeys(sessionKeys{send: key, recv: key})
+	return tcp
+}
+
+func TestLargeJsonEncoding(t *testing.T) {
+	key := newAesKeyLen(32)
+	pkg := AesPackage{PacSN: 1, Cmd: 0x1234, Json: strings.Repeat("a", 200000), ExtData: []byte{1, 2, 3}}
+
+	//对端不支持时拒绝打包
+	legacy := frameCodec{mode: Cipher_AesGcm, extEnc: true}
+	if _, err := pkg.encode(legacy, &frameState{key: key}); err != ErrLargeJsonUnsupported {
+		t.Fatal("应返回 ErrLargeJsonUnsupported", err)
+	}
+
+	codec := frameCodec{mode: Cipher_AesGcm, extEnc: true, caps: Cap_LargeJson}
+	stream, err := pkg.encode(codec, &frameState{key: key})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(stream) != jsonLenEscape {
+		t.Fatal("长度应写为0xFFFF", binary.BigEndian.Uint16(stream))
+	}
+
+	ans, err := testCodecClient(codec, key).decodeAesPkg(1, stream)
+	if nil != err || ans.Cmd != pkg.Cmd || ans.Json != pkg.Json || !bytes.Equal(ans.ExtData, pkg.ExtData) {
+		t.Fatal("解包结果错误", err)
+	}
+
+	//超过接收限制
+	tcp := testCodecClient(codec, key)
+	tcp.MaxJsonSize = 100000
+	if _, err = tcp.decodeAesPkg(1, stream); err != ErrJsonTooLarge {
+		t.Fatal("应返回 ErrJsonTooLarge", err)
+	}
+
+	//小于64KB的JSON段仍使用2字节长度
+	small := AesPackage{Cmd: 1, Json: "hello"}
+	stream, err = small.encode(codec, &frameState{key: key})
+	if nil != err {
+		t.Fatal(err)
+	}
+	if int(binary.BigEndian.Uint16(stream)) != len(stream)-2-sealedExtDataLen(0) {
+		t.Fatal("小JSON段长度错误")
+	}
+}
+
+func TestCompressEncoding(t *testing.T) {
+	key := newAesKeyLen(32)
+	codec := frameCodec{mode: Cipher_AesGcm, seq: true, caps: Cap_Compress | Cap_LargeJson}
+	json := strings.Repeat(`{"name":"networker","value":12345},`, 5000)
+	pkg := AesPackage{PacSN: 2, Cmd: 0x0102, Json: json}
+
+	st := frameState{key: key, seq: 1, compressMin: DefaultCompressThreshold}
+	stream, err := pkg.encode(codec, &st)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(stream) != jsonLenCompressed {
+		t.Fatal("长度应写为0xFFFE", binary.BigEndian.Uint16(stream))
+	}
+	if st.wireLen >= st.bodyLen || len(stream) >= len(json) {
+		t.Fatal("没有压缩", st.wireLen, st.bodyLen)
+	}
+
+	tcp := testCodecClient(codec, key)
+	ans, err := tcp.decodeAesPkg(2, stream)
+	if nil != err || ans.Cmd != pkg.Cmd || ans.Json != json {
+		t.Fatal("解包结果错误", err)
+	}
+	stats := tcp.GetCompressionStats()
+	if stats.RecvRatio() <= 1 {
+		t.Fatal("接收压缩比错误", stats.RecvRatio())
+	}
+
+	//解压后超过限制
+	tcp = testCodecClient(codec, key)
+	tcp.MaxJsonSize = 10000
+	if _, err = tcp.decodeAesPkg(2, stream); err != ErrJsonTooLarge {
+		t.Fatal("应返回 ErrJsonTooLarge", err)
+	}
+
+	//小于阈值时不压缩
+	small := AesPackage{Cmd: 1, Json: "hello"}
+	st = frameState{key: key, seq: 2, compressMin: DefaultCompressThreshold}
+	stream, err = small.encode(codec, &st)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(stream) == jsonLenCompressed || st.wireLen != st.bodyLen {
+		t.Fatal("小于阈值的JSON段被压缩")
+	}
+}
@@ -27,18 +27,79 @@ SOFTWARE.
 package networker
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	ecies "github.com/ecies/go/v2"
 )
 
 type AesTcpClient struct {
 	PackagedTcpClient
-	aesKey       []byte
-	onAesPackage func(tcp *AesTcpClient, pkg *AesPackage)
+	aesKey        []byte //发送密钥
+	recvAesKey    []byte //接收密钥，旧版密钥交换时与发送密钥相同
+	cbind         []byte //会话绑定值，用于SCRAM认证绑定本次会话
+	kexTranscript []byte //密钥交换的握手记录摘要（服务端首条消息 + 客户端回复），用于服务端确认码
+	codec         frameCodec
+	onAesPackage  atomic.Pointer[func(tcp *AesTcpClient, pkg *AesPackage)] //收包协程读取，可在连接期间替换
+	lastErr       error
+	isServer      bool
+	policy        *CmdPolicy  //服务端连接的命令权限表
+	suite         string      //协商的加密套件，旧版对端为空
+	pendingKex    *pendingKex //等待服务端选择套件
+
+	sendSeq     atomic.Uint64
+	recvWindow  replayWindow
+	replayCount atomic.Uint64
+
+	keyLock   sync.RWMutex
+	keyEpoch  uint8              //当前密钥代号
+	oldKeys   [keyHistory][]byte //最近几代旧接收密钥，按代号取模存放
+	nextKeys  sessionKeys        //对端发起更换后待启用的密钥，收到新代号数据帧时启用
+	rekeying  bool               //本端发起的更换进行中，受keyLock保护
+	rekeyLock sync.Mutex
+	keyTime   time.Time
+	keyBytes  atomic.Uint64
+	keyFrames atomic.Uint64
+
+	EnableGcm       bool                                             //服务端不支持套件协商时允许选用AES-128-GCM
+	CipherSuites    []string                                         //支持的加密套件（按优先顺序），服务端连接为选择策略；为空时使用 DefaultCipherSuites
+	RequireAead     bool                                             //严格模式：拒绝不支持套件协商且只能使用AES-CBC的旧对端，默认兼容
+	EnableEcdh      bool                                             //握手时允许协商ECDH密钥交换（前向安全）
+	OnFrameRejected func(tcp *AesTcpClient, pacSN uint16, err error) //数据帧被拒绝（解密或认证失败）时回调
+	Audit           AuditSink                                        //审计事件接收端，服务端连接由 TcpListener.Audit 设置
+
+	MaxPreAuthFrameSize uint32 //认证完成前接收数据帧的最大长度，为0时使用 DefaultMaxPreAuthFrameSize
+	MaxJsonSize         uint32 //接收数据帧JSON段的最大长度，超过时断开连接；为0时不额外限制
+
+	EnableCrc bool //协商数据帧CRC32C校验，用于不可靠的链路（如串口转TCP）上的明文会话
+
+	EnableCompress    bool //协商数据压缩，cmd+Json在加密前用DEFLATE压缩
+	CompressThreshold int  //cmd+Json不小于该字节数时压缩，为0时使用 DefaultCompressThreshold
+	zipCount          compressCounters
+
+	OnStream     func(tcp *AesTcpClient, pkg *AesPackage, stream *StreamReader) //收到数据流时在单独的协程中回调，pkg为打开请求中的cmd和Json；为空时拒绝数据流
+	StreamWindow int                                                            //接收数据流的窗口（字节），为0时使用 DefaultStreamWindow
+	streams      streamTable
+
+	ServerFingerprint string        //固定的服务端身份指纹，非空时只接受该身份
+	KnownServers      *KnownServers //首次信任的服务端身份记录，ServerFingerprint为空时使用
+
+	PskID        string //预共享密钥ID，服务端提供PSK握手时使用，Psk为空时拒绝PSK握手并改用ECC密钥交换
+	Psk          []byte //预共享密钥
+	DeviceKey    *ECC   //设备密钥对，服务端支持时用于设备公钥认证，代替口令
+	SessionToken string //服务端签发的会话令牌，Login成功时更新，重连时优先使用
+
+	//自动更换会话密钥的条件，为0表示不按该条件更换；需双方协商支持
+	RekeyInterval time.Duration
+	RekeyBytes    uint64
+	RekeyFrames   uint64
 }
 
 func NewAesTcpClient() *AesTcpClient {
@@ -53,19 +114,71 @@ func NewAesTcpClientWithConn(conn *net.Conn) *AesTcpClient {
 
 func (tcp *AesTcpClient) SetAesPackageHandler(handler func(tcp *AesTcpClient, pkg *AesPackage)) {
 	if nil == handler {
-		tcp.OnOnePackage = nil
-		tcp.onAesPackage = nil
+		tcp.onPackage.Store(nil)
+		tcp.onAesPackage.Store(nil)
 	} else {
-		tcp.OnOnePackage = tcp.onePackageHandler
-		tcp.onAesPackage = handler
+		//先设置处理函数再启用，收包协程不会看到只设置了一半的状态
+		tcp.onAesPackage.Store(&handler)
+		onPackage := tcp.onePackageHandler
+		tcp.onPackage.Store(&onPackage)
 	}
 }
 
-func (tcp *AesTcpClient) onePackageHandler(client *PackagedTcpClient, pacSN uint16, data []byte) {
-	tcp.onOneAesPackage(tcp.pkg2AesPkg(pacSN, data))
+// GetLastError 最近一次握手、认证或打包失败的原因
+func (tcp *AesTcpClient) GetLastError() error {
+	return tcp.lastErr
+}
+
+// GetReplayCount 因重放或超出窗口被丢弃的数据帧数
+func (tcp *AesTcpClient) GetReplayCount() uint64 {
+	return tcp.replayCount.Load()
+}
+
+func (tcp *AesTcpClient) GetCipherMode() CipherMode {
+	return tcp.codec.mode
+}
+
+// resetSession 清除上一次连接的会话状态，同一个对象重新登录时使用
+func (tcp *AesTcpClient) resetSession() {
+	tcp.codec = frameCodec{}
+	tcp.cbind = nil
+	tcp.kexTranscript = nil
+	tcp.suite = ""
+	tcp.pendingKex = nil
+	tcp.setSessionKeys(sessionKeys{})
+	tcp.sendSeq.Store(0)
+	tcp.recvWindow.reset()
+	tcp.applyFrameCaps(0)
+	tcp.zipCount.reset()
+	tcp.streams.closeAll(ErrStreamClosed)
+}
+
+func (tcp *AesTcpClient) onePackageHandler(pac *Package) {
+	pkg := tcp.pkg2AesPkg(pac.PacSN, pac.Data)
+	if nil == pkg {
+		return
+	}
+	pkg.CorrID = pac.CorrID
+
+	tcp.onOneAesPackage(pkg)
 }
 
 func (tcp *AesTcpClient) onOneAesPackage(pkg *AesPackage) {
+	if !tcp.dispatchAesPackage(pkg) {
+		return
+	}
+
+	handler := tcp.onAesPackage.Load()
+	if nil == handler {
+		return
+	}
+
+	(*handler)(tcp, pkg)
+}
+
+// dispatchAesPackage 处理认证、密钥更换和数据流等内部命令并检查命令权限，
+// 回调和 ReadAesPackage 两种收包方式共用；返回false表示包已处理或被拒绝，不交给调用方
+func (tcp *AesTcpClient) dispatchAesPackage(pkg *AesPackage) bool {
 	//非回复包的认证和心跳包处理
 	if pkg.PacSN&0x8000 <= 0 {
 		switch pkg.Cmd {
@@ -73,56 +186,209 @@ func (tcp *AesTcpClient) onOneAesPackage(pkg *AesPackage) {
 			var cmd AesCmd
 			err := json.Unmarshal([]byte(pkg.Json), &cmd)
 			if nil != err {
-				fmt.Println("AesTcpClient.onOneAesPackage json转对象异常", err)
+				tcp.audit(Audit_KexFailed, "", err.Error(), "ecc")
 			} else {
-				tcp.onAuthorizeCmd(pkg.PacSN, pkg.Cmd, &cmd)
+				tcp.onAuthorizeCmd(pkg, &cmd)
 			}
 
-			return
+			return false
+		case Cmd_PskHello:
+			tcp.onPskHello(pkg)
+			return false
+		case Cmd_CipherSuite:
+			tcp.onCipherSuite(pkg)
+			return false
+		case Cmd_Rekey:
+			tcp.onRekeyCmd(pkg)
+			return false
+		case Cmd_StreamOpen:
+			tcp.onStreamOpen(pkg)
+			return false
+		case Cmd_StreamData:
+			tcp.onStreamData(pkg)
+			return false
+		case Cmd_StreamAck:
+			tcp.onStreamAck(pkg)
+			return false
 		}
 	}
 
-	if nil == tcp.onAesPackage {
-		return
+	//没有被等待的回复包同样交给调用方，也要检查权限
+	return tcp.checkCmdPolicy(pkg)
+}
+
+func (tcp *AesTcpClient) pkg2AesPkg(pacSN uint16, data []byte) *AesPackage {
+	pkg, err := tcp.decodeAesPkg(pacSN, data)
+	if err == ErrJsonTooLarge {
+		tcp.audit(Audit_DecryptFailed, "", err.Error(), "")
+		tcp.Close()
+		return nil
+	}
+	if nil != err {
+		tcp.rejectFrame(pacSN, err)
+		return nil
 	}
 
-	tcp.onAesPackage(tcp, pkg)
+	return pkg
 }
 
-func (tcp *AesTcpClient) pkg2AesPkg(pacSN uint16, data []byte) *AesPackage {
+func (tcp *AesTcpClient) decodeAesPkg(pacSN uint16, data []byte) (*AesPackage, error) {
 	var err error
 	var deData []byte
 
-	jsonLen := (uint16(data[0]) << 8)
-	jsonLen |= uint16(data[1])
+	if len(data) < 2 {
+		return nil, ErrBadFrame
+	}
+
+	jsonLen := uint32(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	compressed := jsonLen == jsonLenCompressed && tcp.codec.caps.Has(Cap_Compress)
+	if compressed || (jsonLen == jsonLenEscape && tcp.codec.caps.Has(Cap_LargeJson)) {
+		if len(data) < 4 {
+			return nil, ErrBadFrame
+		}
+		jsonLen = binary.BigEndian.Uint32(data)
+		data = data[4:]
+	}
+
+	if tcp.MaxJsonSize > 0 && jsonLen > tcp.MaxJsonSize {
+		return nil, ErrJsonTooLarge
+	}
+	if uint64(len(data)) < uint64(jsonLen) {
+		return nil, ErrBadFrame
+	}
 
 	ansPkg := AesPackage{}
 	ansPkg.PacSN = pacSN
-	ansPkg.ExtData = data[2+jsonLen:]
+	ansPkg.ExtData = data[jsonLen:]
+
+	seg := data[:jsonLen]
+	key := tcp.recvKey()
+	nextEpoch := false
+	if nil != key && tcp.codec.rekey {
+		if len(seg) < 1 {
+			return nil, ErrBadFrame
+		}
 
-	// if nil == tcp.AesKey && nil == tcp.Ecc {
-	// 	fmt.Println("AesTcpClient.pkg2AesPkg PacSN=", pacSN, " 解密信息包失败：密钥为空 ")
-	// 	return nil
-	// }
+		key, nextEpoch = tcp.keyForEpoch(seg[0])
+		if nil == key {
+			return nil, ErrUnknownKeyEpoch
+		}
+	}
+
+	if nil != key && tcp.codec.extEnc {
+		ansPkg.ExtData, err = openExtData(ansPkg.ExtData, tcp.codec.mode, key, seg)
+		if nil != err {
+			return nil, err
+		}
+	}
 
 	if jsonLen > 0 {
-		if nil != tcp.aesKey {
-			deData, err = RandomDecrypt(data[2:jsonLen+2], tcp.aesKey)
+		if nil != key {
+			epoch := seg[0]
+			if tcp.codec.rekey {
+				seg = seg[1:]
+			}
+			deData, err = decryptByMode(tcp.codec.mode, seg, key)
 			if nil != err {
-				fmt.Println("AesTcpClient.pkg2AesPkg PacSN=", pacSN, " 解密信息包失败：", err)
-				return nil
+				return nil, err
+			}
+			if nextEpoch {
+				tcp.commitNextKeys(epoch)
 			}
 		} else {
-			deData = data[2 : jsonLen+2]
+			deData = seg
 		}
 
-		// fmt.Println(tcp.ClientFlag, "解密数据:", hex.EncodeToString(data[2:jsonLen+2]), " 解密后:", hex.EncodeToString(deData))
+		// fmt.Println(tcp.ClientFlag, "解密数据:", hex.EncodeToString(data[:jsonLen]), " 解密后:", hex.EncodeToString(deData))
+
+		if nil != key && tcp.codec.seq {
+			if len(deData) < 8 {
+				return nil, ErrBadFrame
+			}
+
+			if !tcp.recvWindow.accept(binary.BigEndian.Uint64(deData)) {
+				tcp.replayCount.Add(1)
+				return nil, ErrReplayedFrame
+			}
+			deData = deData[8:]
+		}
+
+		wireLen := len(deData)
+		if compressed {
+			limit := tcp.MaxJsonSize
+			if limit <= 0 {
+				limit = tcp.maxFrameSize()
+			}
+			deData, err = inflateBody(deData, limit)
+			if nil != err {
+				return nil, err
+			}
+			tcp.zipCount.recvCompressed.Add(1)
+		}
+		tcp.zipCount.recvWire.Add(uint64(wireLen))
+		tcp.zipCount.recvRaw.Add(uint64(len(deData)))
+
+		if len(deData) < 2 {
+			return nil, ErrBadFrame
+		}
 
 		ansPkg.Cmd = (uint16(deData[0]) << 8) | uint16(deData[1])
 		ansPkg.Json = string(deData[2:])
 	}
 
-	return &ansPkg
+	return &ansPkg, nil
+}
+
+// encodePkg 按会话参数打包，失败时记录到 GetLastError 并返回nil
+func (tcp *AesTcpClient) encodePkg(pkg *AesPackage) []byte {
+	st := frameState{compressMin: tcp.compressThreshold()}
+	if tcp.codec.seq {
+		st.seq = tcp.sendSeq.Add(1)
+	}
+
+	tcp.keyLock.RLock()
+	st.key = tcp.aesKey
+	st.epoch = tcp.keyEpoch
+	tcp.keyLock.RUnlock()
+
+	stream, err := pkg.encode(tcp.codec, &st)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.encodePkg PacSN=", pkg.PacSN, " Cmd=", pkg.Cmd, " 打包异常", err)
+		tcp.lastErr = err
+		return nil
+	}
+	tcp.zipCount.sentRaw.Add(uint64(st.bodyLen))
+	tcp.zipCount.sentWire.Add(uint64(st.wireLen))
+	if st.wireLen < st.bodyLen {
+		tcp.zipCount.sentCompressed.Add(1)
+	}
+	tcp.countRekey(len(stream))
+
+	return stream
+}
+
+// beginPreAuth 认证完成前使用较小的数据帧长度限制
+func (tcp *AesTcpClient) beginPreAuth() {
+	limit := tcp.MaxPreAuthFrameSize
+	if limit <= 0 {
+		limit = DefaultMaxPreAuthFrameSize
+	}
+	tcp.frameLimit.Store(limit)
+}
+
+// endPreAuth 认证完成后使用 MaxFrameSize 限制
+func (tcp *AesTcpClient) endPreAuth() {
+	tcp.frameLimit.Store(0)
+}
+
+// rejectFrame 丢弃无法解密或认证失败的数据帧
+func (tcp *AesTcpClient) rejectFrame(pacSN uint16, err error) {
+	tcp.audit(Audit_DecryptFailed, "", err.Error(), "")
+
+	if nil != tcp.OnFrameRejected {
+		tcp.OnFrameRejected(tcp, pacSN, err)
+	}
 }
 
 func (tcp *AesTcpClient) SendJson(sn uint16, cmd uint16, json string, extData []byte) bool {
@@ -132,32 +398,63 @@ func (tcp *AesTcpClient) SendJson(sn uint16, cmd uint16, json string, extData []
 	pkg.PacSN = sn
 	pkg.Cmd = cmd
 
-	return tcp.Send(sn, pkg.ToAesStream(tcp.aesKey))
+	stream := tcp.encodePkg(&pkg)
+	if nil == stream {
+		return false
+	}
+
+	return tcp.Send(sn, stream)
 }
 
 func (tcp *AesTcpClient) SendJsonJava(sn int, cmd int, json string, extData []byte) bool {
 	return tcp.SendJson(uint16(sn), uint16(cmd), json, extData)
 }
 
+// ReplyJson 回复收到的请求，协商了关联ID时带回请求的关联ID，多个请求可以不按收到的顺序回复
+func (tcp *AesTcpClient) ReplyJson(req *AesPackage, cmd uint16, json string, extData []byte) bool {
+	pkg := AesPackage{}
+	pkg.ExtData = extData
+	pkg.Json = json
+	pkg.PacSN = 0x8000 | req.PacSN
+	pkg.Cmd = cmd
+
+	stream := tcp.encodePkg(&pkg)
+	if nil == stream {
+		return false
+	}
+
+	return tcp.SendReply(&Package{PacSN: req.PacSN, CorrID: req.CorrID}, stream)
+}
+
 func (tcp *AesTcpClient) SendJsonAndWait(sn uint16, cmd uint16, json string, extData []byte, msWait int) *AesPackage {
+	pkg, _ := tcp.SendJsonAndWaitErr(sn, cmd, json, extData, msWait)
+	return pkg
+}
+
+// SendJsonAndWaitErr 同 SendJsonAndWait，没有回复时返回原因，如 ErrPacSNInUse、ErrReplyTimeout
+func (tcp *AesTcpClient) SendJsonAndWaitErr(sn uint16, cmd uint16, json string, extData []byte, msWait int) (*AesPackage, error) {
 	pkg := AesPackage{}
 	pkg.ExtData = extData
 	pkg.Json = json
 	pkg.PacSN = sn
 	pkg.Cmd = cmd
 
-	ans := tcp.SendAndWait(sn, pkg.ToAesStream(tcp.aesKey), msWait)
-	if nil == ans {
-		fmt.Println("AesTcpClient.SendJsonAndWait PacSN=", sn, " 没有收到回复 PacSN=")
-		return nil
+	stream := tcp.encodePkg(&pkg)
+	if nil == stream {
+		return nil, tcp.lastErr
 	}
 
-	jsonLen := (uint16(ans.Data[1]) << 8)
-	jsonLen |= uint16(ans.Data[2])
+	ans, err := tcp.SendAndWaitErr(sn, stream, msWait)
+	if nil == ans {
+		return nil, err
+	}
 
 	ansPkg := tcp.pkg2AesPkg(sn, ans.Data)
+	if nil == ansPkg {
+		return nil, tcp.lastErr
+	}
 
-	return ansPkg
+	return ansPkg, nil
 }
 
 func (tcp *AesTcpClient) SendJsonAndWaitJava(sn int, cmd int, json string, extData []byte, msWait int) *AesPackage {
@@ -169,36 +466,33 @@ func (tcp *AesTcpClient) ReadAesPackage() *AesPackage {
 }
 
 func (tcp *AesTcpClient) readAesPackage(msTimeOut int) *AesPackage {
-	pkg := tcp.PackagedTcpClient.readPackage(msTimeOut)
+	for {
+		pkg := tcp.PackagedTcpClient.readPackage(msTimeOut)
 
-	if nil == pkg {
-		return nil
-	}
+		if nil == pkg {
+			return nil
+		}
 
-	aesPkg := tcp.pkg2AesPkg(pkg.PacSN, pkg.Data)
-	if nil == aesPkg {
-		return nil
-	}
+		aesPkg := tcp.pkg2AesPkg(pkg.PacSN, pkg.Data)
+		if nil == aesPkg {
+			return nil
+		}
+		aesPkg.CorrID = pkg.CorrID
 
-	//非回复包的认证和心跳包处理
-	if pkg.PacSN&0x8000 <= 0 {
-		switch aesPkg.Cmd {
-		case Cmd_GetAesKey:
-			var cmd AesCmd
-			err := json.Unmarshal([]byte(aesPkg.Json), &cmd)
-			if nil != err {
-				fmt.Println("AesTcpClient.pkg2AesPkg json转对象异常", err)
-			} else {
-				tcp.onAuthorizeCmd(aesPkg.PacSN, aesPkg.Cmd, &cmd)
-			}
+		//内部命令已处理、没有权限的请求已回复错误，不交给调用方，继续读取下一个包
+		if !tcp.dispatchAesPackage(aesPkg) {
+			continue
 		}
-	}
 
-	return aesPkg
+		return aesPkg
+	}
 }
 
-func (tcp *AesTcpClient) onAuthorizeCmd(pacSN uint16, cmdType uint16, cmd *AesCmd) {
+func (tcp *AesTcpClient) onAuthorizeCmd(pkg *AesPackage, cmd *AesCmd) {
 	var newKey []byte
+	var secret []byte
+	var newCodec frameCodec
+	var nego bool
 
 	newKey = nil
 	ecc := ECC{}
@@ -206,24 +500,50 @@ func (tcp *AesTcpClient) onAuthorizeCmd(pacSN uint16, cmdType uint16, cmd *AesCm
 
 	rslt := AesCmd{}
 
-	switch cmdType {
+	switch pkg.Cmd {
 	case Cmd_GetAesKey:
 		{
-			if nil == cmd.Data || len(cmd.Data.(string)) <= 0 {
-				fmt.Println("AesTcpClient.onAuthorizeCmd 空公钥")
+			//公钥格式错误时回复错误并结束握手
+			bs, _ := cmd.Data.(string)
+			if len(bs) <= 0 {
+				tcp.lastErr = ErrBadFrame
 				rslt.IsOK = false
 				rslt.Msg = "Empty PubKey"
 			} else {
-				bs := cmd.Data.(string)
 				key, err := ecies.NewPublicKeyFromHex(bs)
+				if nil == err {
+					err = tcp.verifyServer(bs, cmd.Ext)
+				}
+				if nil == err && tcp.EnableEcdh && cmd.Ext.hasKex(kexNameEcdh) {
+					//双方临时密钥ECDH，前向安全
+					secret, err = ecc.EccKey.ECDH(key)
+				}
 				if nil != err {
-					fmt.Println("AesTcpClient.onAuthorizeCmd 数据转公钥异常", err)
+					tcp.lastErr = err
 					rslt.IsOK = false
 					rslt.Msg = err.Error()
 				} else {
-					newKey = newAesKey()
 					rslt.IsOK = true
-					rslt.Data = hex.EncodeToString(ecc.Encrypt(newKey, key))
+					newCodec, rslt.Ext = tcp.acceptOffer(cmd.Ext)
+					nego = nil != rslt.Ext && len(rslt.Ext.Suites) > 0
+
+					if nil != secret {
+						rslt.Data = ecc.EccKey.PublicKey.Hex(true)
+						rslt.Ext.Kex = kexNameEcdh
+					} else {
+						//协商套件时密钥材料为32字节，由HKDF派生所选套件的密钥
+						if nego {
+							newKey = newAesKeyLen(32)
+						} else {
+							newKey = newAesKey()
+						}
+						rslt.Data = hex.EncodeToString(ecc.Encrypt(newKey, key))
+					}
+
+					if !nego && !tcp.legacySuiteAllowed(newCodec) {
+						tcp.lastErr = ErrNoCipherSuite
+						rslt = AesCmd{Msg: ErrNoCipherSuite.Error()}
+					}
 				}
 			}
 		}
@@ -235,9 +555,99 @@ func (tcp *AesTcpClient) onAuthorizeCmd(pacSN uint16, cmdType uint16, cmd *AesCm
 		return
 	}
 
-	tcp.SendJson(0x8000|pacSN, cmdType, string(jstr), nil)
+	tcp.ReplyJson(pkg, pkg.Cmd, string(jstr), nil)
+
+	if nil != tcp.lastErr {
+		tcp.audit(Audit_KexFailed, "", tcp.lastErr.Error(), "ecc")
+		tcp.Close()
+		return
+	}
+
+	tcp.kexTranscript = transcriptHash(pkg.Json, string(jstr))
+
+	if nego {
+		if nil == secret {
+			secret = newKey
+		}
+		tcp.pendingKex = &pendingKex{secret: secret, hello: pkg.Json, reply: string(jstr), codec: newCodec}
+		return
+	}
 
-	if nil != newKey {
-		tcp.aesKey = newKey
+	if nil != secret {
+		tcp.codec = newCodec
+		tcp.setDerivedKeys(secret, transcriptHash(pkg.Json, string(jstr)), 16)
+	} else if nil != newKey {
+		tcp.codec = newCodec
+		tcp.setEciesKey(newKey)
 	}
 }
+
+// acceptOffer 按服务端提供的扩展功能确定帧编码参数和回复的选择，旧版服务端没有扩展字段
+func (tcp *AesTcpClient) acceptOffer(offer *HandshakeExt) (frameCodec, *HandshakeExt) {
+	var codec frameCodec
+
+	//服务端提供了GCM且本端允许时选用GCM
+	if tcp.EnableGcm && offer.hasCipher(cipherNameAesGcm) {
+		codec.mode = Cipher_AesGcm
+	}
+
+	if nil == offer {
+		return codec, nil
+	}
+
+	//服务端支持的扩展功能全部启用
+	codec.extEnc = offer.ExtEnc
+	codec.seq = offer.Seq
+	codec.rekey = offer.Rekey
+
+	choice := &HandshakeExt{ExtEnc: codec.extEnc, Seq: codec.seq, Rekey: codec.rekey}
+	tcp.agreeProtocol(&codec, offer, choice)
+	if offer.Nego {
+		//服务端按策略从本端列表中选择套件，加密模式在套件确定后设置
+		codec.mode = Cipher_AesCbc
+		choice.Suites = tcp.cipherSuiteList()
+	} else if codec.mode != Cipher_AesCbc {
+		choice.Cipher = codec.mode.String()
+	}
+
+	return codec, choice
+}
+
+// verifyServer 校验服务端用长期身份密钥对临时公钥的签名，并与固定指纹或已知服务端记录比对
+func (tcp *AesTcpClient) verifyServer(ephemeralHex string, ext *HandshakeExt) error {
+	if len(tcp.ServerFingerprint) <= 0 && nil == tcp.KnownServers {
+		return nil
+	}
+
+	if nil == ext || len(ext.IdKey) <= 0 {
+		return ErrServerNotVerified
+	}
+
+	//当前身份密钥在前，其后为轮换过渡期内的旧密钥，每个签名都必须有效
+	proofs := append([]idProof{{Key: ext.IdKey, Sign: ext.IdSign}}, ext.IdAlts...)
+	fps := make([]string, 0, len(proofs))
+	for _, proof := range proofs {
+		idKey, err := ecies.NewPublicKeyFromHex(proof.Key)
+		if nil != err {
+			return ErrServerNotVerified
+		}
+
+		sig, err := hex.DecodeString(proof.Sign)
+		if nil != err || !VerifySign(idKey, serverKeySignData(ephemeralHex, ext), sig) {
+			return ErrServerNotVerified
+		}
+
+		fps = append(fps, Fingerprint(idKey))
+	}
+
+	if len(tcp.ServerFingerprint) > 0 {
+		for _, fp := range fps {
+			if strings.EqualFold(fp, tcp.ServerFingerprint) {
+				return nil
+			}
+		}
+		return ErrServerKeyMismatch
+	}
+
+	return tcp.KnownServers.Check(tcp.remoteAddr, fps[0], fps[1:]...)
+}
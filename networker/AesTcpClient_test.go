@@ -0,0 +1,24 @@
+package networker
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestAuthorizeCmdBadPubKey(t *testing.T) {
+	for _, data := range []any{nil, 12345.0, map[string]any{"key": "x"}, "not hex"} {
+		local, remote := net.Pipe()
+		go io.Copy(io.Discard, remote)
+
+		tcp := NewAesTcpClientWithConn(&local)
+		pkg := &AesPackage{PacSN: 1, Cmd: Cmd_GetAesKey}
+		tcp.onAuthorizeCmd(pkg, &AesCmd{IsOK: true, Data: data})
+
+		//公钥格式错误时结束握手，不能panic
+		if nil == tcp.GetLastError() || tcp.IsConnected() {
+			t.Fatal(data, "握手没有失败", tcp.GetLastError())
+		}
+		remote.Close()
+	}
+}
@@ -0,0 +1,190 @@
+package networker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 安全审计事件：握手、认证、解密失败、锁定、踢出等结果以结构化事件输出到可替换的接收端，
+// 内置按大小滚动的JSON Lines文件写入器
+
+type AuditEventType string
+
+const (
+	Audit_ConnAccepted  AuditEventType = "conn_accepted"  //接受连接
+	Audit_ConnRejected  AuditEventType = "conn_rejected"  //来源IP被锁定，直接断开
+	Audit_KexOK         AuditEventType = "kex_ok"         //密钥交换成功，Detail为加密套件
+	Audit_KexFailed     AuditEventType = "kex_failed"     //密钥交换失败
+	Audit_LegacyCipher  AuditEventType = "legacy_cipher"  //对端不支持套件协商，使用旧方式的加密模式，Detail为套件
+	Audit_AuthOK        AuditEventType = "auth_ok"        //认证成功，Detail为认证方式
+	Audit_AuthFailed    AuditEventType = "auth_failed"    //认证失败，Reason为 AuthReason
+	Audit_DecryptFailed AuditEventType = "decrypt_failed" //数据帧解密或认证失败、重放
+	Audit_Lockout       AuditEventType = "lockout"        //认证失败次数过多被锁定，Detail为锁定类型
+	Audit_Kick          AuditEventType = "kick"           //服务端主动断开连接
+	Audit_CmdDenied     AuditEventType = "cmd_denied"     //命令权限检查未通过，Detail为命令码
+)
+
+type AuditEvent struct {
+	Time       time.Time      `json:"time"`
+	Type       AuditEventType `json:"type"`
+	RemoteAddr string         `json:"remote"`
+	User       string         `json:"user,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Detail     string         `json:"detail,omitempty"`
+}
+
+// AuditSink 审计事件接收端，可能被多个连接的协程同时调用
+type AuditSink interface {
+	WriteEvent(ev *AuditEvent)
+}
+
+// AuditSinkFunc 函数形式的 AuditSink
+type AuditSinkFunc func(ev *AuditEvent)
+
+func (f AuditSinkFunc) WriteEvent(ev *AuditEvent) {
+	f(ev)
+}
+
+// audit 输出本连接的审计事件
+func (tcp *AesTcpClient) audit(evType AuditEventType, user string, reason string, detail string) {
+	if nil == tcp.Audit {
+		return
+	}
+
+	if len(user) <= 0 && nil != tcp.User {
+		user = tcp.User.Name
+	}
+
+	tcp.Audit.WriteEvent(&AuditEvent{
+		Time:       time.Now(),
+		Type:       evType,
+		RemoteAddr: tcp.remoteAddr,
+		User:       user,
+		Reason:     reason,
+		Detail:     detail,
+	})
+}
+
+// errText 审计事件中的错误信息，没有错误时为空
+func errText(err error) string {
+	if nil == err {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// Kick 服务端主动断开连接并记录审计事件
+func (tcp *AesTcpClient) Kick(reason string) {
+	tcp.audit(Audit_Kick, "", reason, "")
+	fmt.Println(tcp.ClientFlag, "AesTcpClient.Kick", tcp.remoteAddr, reason)
+	tcp.Close()
+}
+
+// AuditFileWriter 按大小滚动的JSON Lines审计文件，超过MaxSize时当前文件改名为 path.1，已有的备份依次后移
+type AuditFileWriter struct {
+	Path       string
+	MaxSize    int64 //单个文件最大字节数，为0时不滚动
+	MaxBackups int   //保留的备份文件数量
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAuditFileWriter(path string, maxSize int64, maxBackups int) (*AuditFileWriter, error) {
+	w := &AuditFileWriter{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+
+	err := w.open()
+	if nil != err {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *AuditFileWriter) open() error {
+	file, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if nil != err {
+		return err
+	}
+
+	info, err := file.Stat()
+	if nil != err {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = info.Size()
+
+	return nil
+}
+
+func (w *AuditFileWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+
+	if w.MaxBackups <= 0 {
+		os.Remove(w.Path)
+	} else {
+		for idx := w.MaxBackups - 1; idx >= 1; idx-- {
+			os.Rename(w.Path+"."+strconv.Itoa(idx), w.Path+"."+strconv.Itoa(idx+1))
+		}
+		os.Rename(w.Path, w.Path+".1")
+	}
+
+	return w.open()
+}
+
+func (w *AuditFileWriter) WriteEvent(ev *AuditEvent) {
+	line, err := json.Marshal(ev)
+	if nil != err {
+		fmt.Println("AuditFileWriter 事件转JSON异常", err)
+		return
+	}
+	line = append(line, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if nil == w.file {
+		err = w.open()
+		if nil != err {
+			fmt.Println("AuditFileWriter 打开文件异常", err)
+			return
+		}
+	}
+
+	if w.MaxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.MaxSize {
+		err = w.rotate()
+		if nil != err {
+			fmt.Println("AuditFileWriter 滚动文件异常", err)
+			return
+		}
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	if nil != err {
+		fmt.Println("AuditFileWriter 写入异常", err)
+	}
+}
+
+func (w *AuditFileWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if nil == w.file {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
@@ -0,0 +1,145 @@
+package networker
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAuditLog 记录审计事件的接收端
+type testAuditLog struct {
+	lock   sync.Mutex
+	events []AuditEvent
+}
+
+func (l *testAuditLog) WriteEvent(ev *AuditEvent) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.events = append(l.events, *ev)
+}
+
+// wait 等待指定类型的事件，超时返回nil
+func (l *testAuditLog) wait(evType AuditEventType) *AuditEvent {
+	for tmBegin := time.Now(); time.Since(tmBegin) < 3*time.Second; time.Sleep(10 * time.Millisecond) {
+		l.lock.Lock()
+		for idx := range l.events {
+			if l.events[idx].Type == evType {
+				ev := l.events[idx]
+				l.lock.Unlock()
+				return &ev
+			}
+		}
+		l.lock.Unlock()
+	}
+
+	return nil
+}
+
+func (l *testAuditLog) contains(text string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, ev := range l.events {
+		line, _ := json.Marshal(ev)
+		if strings.Contains(string(line), text) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestAuditLogin(t *testing.T) {
+	svrLog := &testAuditLog{}
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.Audit = svrLog
+	})
+
+	//认证失败，服务端和客户端都输出事件
+	cliLog := &testAuditLog{}
+	cli := NewAesTcpClient()
+	cli.Audit = cliLog
+	if cli.Login("127.0.0.1", port, "admin", "secret-pwd", 3000) {
+		t.Fatal("错误口令登录成功")
+	}
+	<-ch
+
+	for _, evType := range []AuditEventType{Audit_ConnAccepted, Audit_KexOK} {
+		if nil == svrLog.wait(evType) {
+			t.Fatal("服务端没有输出事件", evType)
+		}
+	}
+	ev := svrLog.wait(Audit_AuthFailed)
+	if nil == ev || ev.User != "admin" || ev.Reason != string(AuthReason_BadCredentials) {
+		t.Fatal("服务端认证失败事件错误", ev)
+	}
+	ev = cliLog.wait(Audit_AuthFailed)
+	if nil == ev || ev.User != "admin" || !strings.Contains(ev.Detail, string(AuthReason_BadCredentials)) {
+		t.Fatal("客户端认证失败事件错误", ev)
+	}
+
+	//认证成功后被踢出
+	cli = NewAesTcpClient()
+	testLogin(t, cli, port)
+	svr := <-ch
+	if ev = svrLog.wait(Audit_AuthOK); nil == ev || ev.User != "admin" || ev.Detail != "password" {
+		t.Fatal("服务端认证成功事件错误", ev)
+	}
+	svr.Kick("maintenance")
+	if ev = svrLog.wait(Audit_Kick); nil == ev || ev.Reason != "maintenance" {
+		t.Fatal("踢出事件错误", ev)
+	}
+
+	//事件中不含口令
+	if svrLog.contains("secret-pwd") || cliLog.contains("secret-pwd") {
+		t.Fatal("审计事件含有口令")
+	}
+}
+
+func TestAuditFileWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	w, err := NewAuditFileWriter(path, 300, 2)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for idx := 0; idx < 20; idx++ {
+		w.WriteEvent(&AuditEvent{Time: time.Now(), Type: Audit_AuthFailed, User: "admin", Reason: string(AuthReason_BadCredentials)})
+	}
+	if err = w.Close(); nil != err {
+		t.Fatal(err)
+	}
+
+	//当前文件和两个备份，每行都是完整的事件
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		file, err := os.Open(name)
+		if nil != err {
+			t.Fatal("缺少审计文件", name, err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		lines := 0
+		for scanner.Scan() {
+			var ev AuditEvent
+			if err = json.Unmarshal(scanner.Bytes(), &ev); nil != err || ev.Type != Audit_AuthFailed {
+				t.Fatal("事件格式错误", name, scanner.Text())
+			}
+			lines++
+		}
+		file.Close()
+
+		info, _ := os.Stat(name)
+		if 0 == lines || info.Size() > 300 {
+			t.Fatal("文件滚动错误", name, lines, info.Size())
+		}
+	}
+	if _, err = os.Stat(path + ".3"); nil == err {
+		t.Fatal("备份数量超过限制")
+	}
+}
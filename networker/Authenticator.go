@@ -0,0 +1,82 @@
+package networker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// authenticateTimeout 每次调用 Authenticator 的超时时间，不包括等待客户端回复的时间
+const authenticateTimeout = 3 * time.Second
+
+// AuthReason 认证被拒绝的原因，随 Cmd_AuthorizeResult 发送给客户端
+type AuthReason string
+
+const (
+	AuthReason_BadRequest       AuthReason = "bad_request"         //认证数据格式错误
+	AuthReason_BadCredentials   AuthReason = "bad_credentials"     //用户名、口令、设备密钥或令牌不正确
+	AuthReason_UnknownUser      AuthReason = "unknown_user"        //用户不存在
+	AuthReason_Disabled         AuthReason = "account_disabled"    //账号已停用
+	AuthReason_Expired          AuthReason = "credentials_expired" //口令或账号已过期
+	AuthReason_Locked           AuthReason = "locked"              //失败次数过多，临时锁定
+	AuthReason_MethodNotAllowed AuthReason = "method_not_allowed"  //不允许该认证方式
+	AuthReason_Internal         AuthReason = "internal_error"      //服务端内部错误
+)
+
+// AuthError 带拒绝原因的认证错误
+type AuthError struct {
+	Reason AuthReason
+	Msg    string
+}
+
+func NewAuthError(reason AuthReason, msg string) *AuthError {
+	return &AuthError{Reason: reason, Msg: msg}
+}
+
+func (e *AuthError) Error() string {
+	if len(e.Msg) <= 0 {
+		return string(e.Reason)
+	}
+
+	return string(e.Reason) + ": " + e.Msg
+}
+
+// toAuthError 其他错误按内部错误处理
+func toAuthError(err error) *AuthError {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr
+	}
+
+	return NewAuthError(AuthReason_Internal, err.Error())
+}
+
+// Credentials 客户端提交的认证信息
+type Credentials struct {
+	Method     string //认证方式：password、scram-sha-256、device-key、token
+	Name       string
+	Password   string //仅password方式有效
+	DeviceKey  string //device-key方式为设备公钥指纹
+	RemoteAddr string
+}
+
+// Authenticator 认证并返回用户身份，拒绝时返回 *AuthError
+// password方式需校验口令；SCRAM、设备密钥、令牌方式已由协议校验，只需查找身份或拒绝账号（如已停用）
+type Authenticator interface {
+	Authenticate(ctx context.Context, cred *Credentials) (*LoginUserInfo, error)
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator
+type AuthenticatorFunc func(ctx context.Context, cred *Credentials) (*LoginUserInfo, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, cred *Credentials) (*LoginUserInfo, error) {
+	return f(ctx, cred)
+}
+
+// authenticate 调用 Authenticator，超时从调用时开始计算
+func (lsn *TcpListener) authenticate(cred *Credentials) (*LoginUserInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), authenticateTimeout)
+	defer cancel()
+
+	return lsn.Authenticator.Authenticate(ctx, cred)
+}
@@ -0,0 +1,257 @@
+package networker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	ErrBadFrame     = errors.New("malformed frame")                 //数据帧格式错误
+	ErrJsonTooLarge = errors.New("json segment exceeds size limit") //JSON段超过 MaxJsonSize
+)
+
+// CipherMode 对称加密模式
+type CipherMode uint8
+
+const (
+	Cipher_AesCbc           CipherMode = iota //旧版AES-CBC，无完整性校验
+	Cipher_AesGcm                             //AES-GCM认证加密，每帧随机nonce
+	Cipher_ChaCha20Poly1305                   //ChaCha20-Poly1305认证加密，每帧随机nonce
+)
+
+// 握手时使用的加密模式名称
+const (
+	cipherNameAesCbc   = "aes-cbc"
+	cipherNameAesGcm   = "aes-gcm"
+	cipherNameChaCha20 = "chacha20-poly1305"
+)
+
+func (mode CipherMode) String() string {
+	switch mode {
+	case Cipher_AesGcm:
+		return cipherNameAesGcm
+	case Cipher_ChaCha20Poly1305:
+		return cipherNameChaCha20
+	default:
+		return cipherNameAesCbc
+	}
+}
+
+// newAead 认证加密模式的AEAD实例
+func newAead(mode CipherMode, key []byte) (cipher.AEAD, error) {
+	if mode == Cipher_ChaCha20Poly1305 {
+		return chacha20poly1305.New(key)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// ChaCha20Poly1305Encrypt 输出格式与 AesGcmEncrypt 相同：12字节nonce + 密文 + 16字节tag
+func ChaCha20Poly1305Encrypt(data []byte, key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err = rand.Read(out); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, out, data, nil), nil
+}
+
+// ChaCha20Poly1305Decrypt 解密并校验，校验失败返回 ErrFrameAuthFailed
+func ChaCha20Poly1305Decrypt(data []byte, key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrFrameAuthFailed
+	}
+
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrFrameAuthFailed
+	}
+
+	return plain, nil
+}
+
+func encryptByMode(mode CipherMode, data []byte, key []byte) ([]byte, error) {
+	switch mode {
+	case Cipher_AesGcm:
+		return AesGcmEncrypt(data, key)
+	case Cipher_ChaCha20Poly1305:
+		return ChaCha20Poly1305Encrypt(data, key)
+	default:
+		return RandomEncrypt(data, key)
+	}
+}
+
+func decryptByMode(mode CipherMode, data []byte, key []byte) ([]byte, error) {
+	switch mode {
+	case Cipher_AesGcm:
+		return AesGcmDecrypt(data, key)
+	case Cipher_ChaCha20Poly1305:
+		return ChaCha20Poly1305Decrypt(data, key)
+	default:
+		if len(data) <= 0 || len(data)%16 != 0 {
+			return nil, ErrBadFrame
+		}
+
+		return RandomDecrypt(data, key)
+	}
+}
+
+// frameCodec 握手协商得到的帧编码参数
+type frameCodec struct {
+	mode   CipherMode
+	extEnc bool       //ExtData加密
+	seq    bool       //加密数据前附加8字节发送序号，用于防重放
+	rekey  bool       //加密数据段前附加1字节密钥代号，支持会话中更换密钥
+	ver    uint16     //协商的协议版本
+	caps   Capability //协商的功能
+}
+
+// frameState 打包单个数据帧使用的密钥和序号
+type frameState struct {
+	key         []byte
+	epoch       uint8
+	seq         uint64
+	compressMin int //cmd+Json不小于该长度时压缩，为0时不压缩
+
+	bodyLen int //打包结果：cmd+Json长度
+	wireLen int //打包结果：压缩后的cmd+Json长度，未压缩时与bodyLen相同
+}
+
+// ExtData分块加密：8字节随机前缀 + 若干块(密文+16字节tag)
+// 每块明文最大 extChunkSize，nonce = 前缀 + 4字节块序号，
+// 附加数据绑定本帧cmd+Json密文、块序号和是否最后一块，防止块被替换、重排或截断
+const (
+	extChunkSize  = 64 * 1024
+	extPrefixSize = 8
+	extTagSize    = 16
+)
+
+// extDataKey 由会话密钥派生ExtData专用密钥
+func extDataKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("networker extdata"))
+	return mac.Sum(nil)[:len(key)]
+}
+
+// newExtAead ChaCha20-Poly1305会话使用ChaCha20-Poly1305，其他使用AES-GCM
+func newExtAead(mode CipherMode, key []byte) (cipher.AEAD, error) {
+	if mode != Cipher_ChaCha20Poly1305 {
+		mode = Cipher_AesGcm
+	}
+
+	return newAead(mode, extDataKey(key))
+}
+
+func extChunkAad(head []byte, idx uint32, last bool) []byte {
+	aad := make([]byte, 0, len(head)+5)
+	aad = append(aad, head...)
+	aad = binary.BigEndian.AppendUint32(aad, idx)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// sealedExtDataLen 加密后的ExtData长度
+func sealedExtDataLen(plainLen int) int {
+	chunks := (plainLen + extChunkSize - 1) / extChunkSize
+	if chunks <= 0 {
+		chunks = 1
+	}
+
+	return extPrefixSize + plainLen + chunks*extTagSize
+}
+
+// sealExtData 分块加密ExtData并追加到dst之后，不额外复制整块数据
+func sealExtData(dst []byte, ext []byte, mode CipherMode, key []byte, head []byte) ([]byte, error) {
+	gcm, err := newExtAead(mode, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce[:extPrefixSize]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce[:extPrefixSize]...)
+
+	for idx := uint32(0); ; idx++ {
+		chunk := ext
+		if len(chunk) > extChunkSize {
+			chunk = chunk[:extChunkSize]
+		}
+		ext = ext[len(chunk):]
+		last := len(ext) <= 0
+
+		binary.BigEndian.PutUint32(nonce[extPrefixSize:], idx)
+		dst = gcm.Seal(dst, nonce, chunk, extChunkAad(head, idx, last))
+
+		if last {
+			return dst, nil
+		}
+	}
+}
+
+// openExtData 分块原地解密ExtData，返回的明文复用data的存储
+func openExtData(data []byte, mode CipherMode, key []byte, head []byte) ([]byte, error) {
+	if len(data) < extPrefixSize+extTagSize {
+		return nil, ErrFrameAuthFailed
+	}
+
+	gcm, err := newExtAead(mode, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	copy(nonce, data[:extPrefixSize])
+
+	rd := extPrefixSize
+	wr := 0
+	for idx := uint32(0); ; idx++ {
+		chunkLen := len(data) - rd
+		if chunkLen > extChunkSize+extTagSize {
+			chunkLen = extChunkSize + extTagSize
+		}
+		if chunkLen < extTagSize {
+			return nil, ErrFrameAuthFailed
+		}
+		last := rd+chunkLen >= len(data)
+
+		binary.BigEndian.PutUint32(nonce[extPrefixSize:], idx)
+		chunk := data[rd : rd+chunkLen]
+		plain, err := gcm.Open(chunk[:0], nonce, chunk, extChunkAad(head, idx, last))
+		if err != nil {
+			return nil, ErrFrameAuthFailed
+		}
+
+		wr += copy(data[wr:], plain)
+		rd += chunkLen
+
+		if last {
+			return data[:wr], nil
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package networker
+
+import (
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 加密套件协商：
+//  1. 服务端在密钥交换首条消息的Ext中设置SuiteNego，表示支持协商
+//  2. 客户端在回复的Ext.Suites中按优先顺序列出支持的套件，并提供密钥材料（ECDH公钥、ECIES加密的32字节密钥或PSK确认）
+//  3. 服务端按自己的策略选择套件，明文发送 Cmd_CipherSuite，附带由密钥材料和握手记录计算的确认码
+//  4. 客户端检查套件在自己的列表中并校验确认码，双方由密钥材料、握手记录和套件名派生会话密钥
+// 客户端列表和服务端的选择都计入握手记录，中间人修改任何一方都会导致确认码校验失败；
+// 旧版对端不支持协商时按旧方式确定加密模式（AES-CBC或AES-128-GCM），默认继续接受以兼容已部署的对端，
+// 每次使用旧方式都输出 Audit_LegacyCipher 审计事件；设置了 CipherSuites 时只接受其中列出的旧方式套件，
+// 设置 RequireAead 时拒绝AES-CBC，不再兼容只支持CBC的旧对端。
+// 另外服务端在第一条加密消息（Cmd_GetUserNamePwd）中发送整个密钥交换握手记录的确认码，
+// 协议版本2及以上的客户端必须校验，中间人删除协商字段无法使新版双方之间的会话降级
+
+const (
+	Suite_Aes128Cbc        = "aes-128-cbc"
+	Suite_Aes128Gcm        = "aes-128-gcm"
+	Suite_Aes256Gcm        = "aes-256-gcm"
+	Suite_ChaCha20Poly1305 = "chacha20-poly1305"
+)
+
+// DefaultCipherSuites 默认的协商套件列表（按优先顺序），只包含AEAD套件；不支持协商的旧对端见 legacySuiteAllowed
+var DefaultCipherSuites = []string{Suite_Aes256Gcm, Suite_ChaCha20Poly1305, Suite_Aes128Gcm}
+
+var (
+	ErrNoCipherSuite     = errors.New("no acceptable cipher suite")
+	ErrHandshakeMismatch = errors.New("handshake confirmation mismatch")
+	ErrKexRefused        = errors.New("peer refused key exchange")
+	ErrUnknownPskID      = errors.New("unknown pre-shared key id")
+	ErrPskMismatch       = errors.New("pre-shared key confirmation mismatch")
+	ErrPskDeclined       = errors.New("peer has no pre-shared key")
+)
+
+type cipherSuite struct {
+	mode   CipherMode
+	keyLen int
+}
+
+var cipherSuites = map[string]cipherSuite{
+	Suite_Aes128Cbc:        {Cipher_AesCbc, 16},
+	Suite_Aes128Gcm:        {Cipher_AesGcm, 16},
+	Suite_Aes256Gcm:        {Cipher_AesGcm, 32},
+	Suite_ChaCha20Poly1305: {Cipher_ChaCha20Poly1305, 32},
+}
+
+// suiteConfirm 服务端选择的套件和确认码
+type suiteConfirm struct {
+	Suite string `json:"suite"`
+	Mac   string `json:"mac"`
+}
+
+// pendingKex 客户端等待服务端选择套件时保存的握手状态
+type pendingKex struct {
+	secret []byte
+	hello  string //服务端首条消息
+	reply  string //客户端回复
+	codec  frameCodec
+}
+
+func hasSuite(suites []string, name string) bool {
+	for _, s := range suites {
+		if s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pickCipherSuite 按服务端策略顺序选择第一个客户端也支持的套件
+func pickCipherSuite(policy []string, offered []string) string {
+	for _, name := range policy {
+		if _, known := cipherSuites[name]; known && hasSuite(offered, name) {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// legacySuiteName 旧版协商方式对应的套件
+func legacySuiteName(mode CipherMode) string {
+	if mode == Cipher_AesGcm {
+		return Suite_Aes128Gcm
+	}
+
+	return Suite_Aes128Cbc
+}
+
+// suiteFinishedMac 服务端确认码，证明服务端得到了相同的密钥材料和握手记录
+func suiteFinishedMac(secret []byte, transcript []byte) []byte {
+	return hkdfExpand(secret, transcript, "networker server finished", 32)
+}
+
+func (tcp *AesTcpClient) cipherSuiteList() []string {
+	if len(tcp.CipherSuites) > 0 {
+		return tcp.CipherSuites
+	}
+
+	return DefaultCipherSuites
+}
+
+// legacySuiteAllowed 对端不支持协商时是否接受旧方式确定的加密模式：RequireAead 时拒绝CBC，
+// 明确配置了 CipherSuites 时须在列表中，否则默认接受；接受时输出审计事件
+func (tcp *AesTcpClient) legacySuiteAllowed(codec frameCodec) bool {
+	name := legacySuiteName(codec.mode)
+	if tcp.RequireAead && codec.mode == Cipher_AesCbc {
+		tcp.audit(Audit_KexFailed, "", ErrNoCipherSuite.Error(), name)
+		return false
+	}
+	if len(tcp.CipherSuites) > 0 && !hasSuite(tcp.CipherSuites, name) {
+		tcp.audit(Audit_KexFailed, "", ErrNoCipherSuite.Error(), name)
+		return false
+	}
+
+	tcp.audit(Audit_LegacyCipher, "", "", name)
+	return true
+}
+
+// checkFinish 客户端校验服务端对密钥交换握手记录的确认码，协议版本2及以上的会话必须提供；TLS连接没有密钥交换，不校验
+func (tcp *AesTcpClient) checkFinish(ext *HandshakeExt) error {
+	if nil == tcp.kexTranscript {
+		return nil
+	}
+
+	finish := ""
+	if nil != ext {
+		finish = ext.Finish
+	}
+	if len(finish) <= 0 {
+		if tcp.codec.ver > protocolVersionLegacy {
+			return ErrHandshakeMismatch
+		}
+		return nil
+	}
+
+	mac, err := hex.DecodeString(finish)
+	if nil != err || !hmac.Equal(mac, handshakeFinishMac(tcp.cbind, tcp.kexTranscript)) {
+		return ErrHandshakeMismatch
+	}
+
+	return nil
+}
+
+// GetCipherSuite 当前会话使用的加密套件，TLS连接返回TLS套件名
+func (tcp *AesTcpClient) GetCipherSuite() string {
+	if state, ok := tcp.GetTLSState(); ok {
+		return "tls:" + tls.CipherSuiteName(state.CipherSuite)
+	}
+
+	if len(tcp.suite) > 0 {
+		return tcp.suite
+	}
+
+	return legacySuiteName(tcp.codec.mode)
+}
+
+// setSuiteKeys 按协商的套件派生会话密钥
+func (tcp *AesTcpClient) setSuiteKeys(name string, secret []byte, transcript []byte) {
+	suite := cipherSuites[name]
+
+	tcp.suite = name
+	tcp.codec.mode = suite.mode
+	tcp.setDerivedKeys(secret, transcript, suite.keyLen)
+}
+
+// negotiateSuite 服务端选择套件，发送选择结果和确认码后设置会话密钥
+func (ptc *AesTcpClient) negotiateSuite(secret []byte, hello string, reply string, offered []string) bool {
+	name := pickCipherSuite(ptc.cipherSuiteList(), offered)
+	if len(name) <= 0 {
+		fmt.Println(ptc.ClientFlag, "No acceptable cipher suite, client offered:", offered)
+		rslt := AesCmd{Msg: ErrNoCipherSuite.Error()}
+		ptc.SendJson(ptc.GetNexPacSN(), Cmd_CipherSuite, rslt.ToJson(), nil)
+		return false
+	}
+
+	transcript := transcriptHash(hello, reply, name)
+	rslt := AesCmd{IsOK: true, Data: suiteConfirm{Suite: name, Mac: hex.EncodeToString(suiteFinishedMac(secret, transcript))}}
+	ptc.SendJson(ptc.GetNexPacSN(), Cmd_CipherSuite, rslt.ToJson(), nil)
+
+	ptc.setSuiteKeys(name, secret, transcript)
+	fmt.Println(ptc.ClientFlag, "Cipher suite:", name)
+
+	return true
+}
+
+// onCipherSuite 客户端校验服务端选择的套件
+func (tcp *AesTcpClient) onCipherSuite(pkg *AesPackage) {
+	pending := tcp.pendingKex
+	tcp.pendingKex = nil
+	if nil == pending {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onCipherSuite 没有进行中的握手")
+		return
+	}
+
+	var ans struct {
+		AesCmd
+		Data suiteConfirm `json:"data"`
+	}
+	err := json.Unmarshal([]byte(pkg.Json), &ans)
+	if nil != err || !ans.IsOK {
+		tcp.lastErr = ErrNoCipherSuite
+	} else if !hasSuite(tcp.cipherSuiteList(), ans.Data.Suite) {
+		tcp.lastErr = ErrNoCipherSuite
+	} else {
+		transcript := transcriptHash(pending.hello, pending.reply, ans.Data.Suite)
+		mac, err := hex.DecodeString(ans.Data.Mac)
+		if nil != err || !hmac.Equal(mac, suiteFinishedMac(pending.secret, transcript)) {
+			tcp.lastErr = ErrHandshakeMismatch
+		} else {
+			tcp.codec = pending.codec
+			tcp.setSuiteKeys(ans.Data.Suite, pending.secret, transcript)
+			return
+		}
+	}
+
+	fmt.Println(tcp.ClientFlag, "AesTcpClient.onCipherSuite 套件协商失败", tcp.lastErr)
+	tcp.Close()
+}
@@ -0,0 +1,49 @@
+package networker
+
+import "testing"
+
+func TestLegacySuiteAllowed(t *testing.T) {
+	var events []*AuditEvent
+	sink := AuditSinkFunc(func(ev *AuditEvent) { events = append(events, ev) })
+
+	//默认兼容旧对端，并输出审计事件
+	tcp := &AesTcpClient{Audit: sink}
+	if !tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesCbc}) || !tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesGcm}) {
+		t.Fatal("默认配置拒绝了旧对端")
+	}
+	if len(events) != 2 || events[0].Type != Audit_LegacyCipher || events[0].Detail != Suite_Aes128Cbc {
+		t.Fatal("没有输出 Audit_LegacyCipher 事件", events)
+	}
+
+	//严格模式拒绝CBC，旧方式的GCM仍可使用
+	events = nil
+	tcp = &AesTcpClient{Audit: sink, RequireAead: true}
+	if tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesCbc}) {
+		t.Fatal("RequireAead 时接受了CBC")
+	}
+	if !tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesGcm}) {
+		t.Fatal("RequireAead 时拒绝了GCM")
+	}
+	if len(events) != 2 || events[0].Type != Audit_KexFailed {
+		t.Fatal("拒绝时没有输出 Audit_KexFailed 事件", events)
+	}
+
+	//明确配置的套件列表
+	tcp = &AesTcpClient{CipherSuites: []string{Suite_Aes256Gcm, Suite_Aes128Cbc}}
+	if !tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesCbc}) || tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesGcm}) {
+		t.Fatal("没有按 CipherSuites 判断")
+	}
+	tcp.RequireAead = true
+	if tcp.legacySuiteAllowed(frameCodec{mode: Cipher_AesCbc}) {
+		t.Fatal("RequireAead 优先于 CipherSuites")
+	}
+}
+
+func TestPickCipherSuite(t *testing.T) {
+	if name := pickCipherSuite(DefaultCipherSuites, []string{Suite_Aes128Gcm, Suite_ChaCha20Poly1305}); name != Suite_ChaCha20Poly1305 {
+		t.Fatal("应按服务端顺序选择", name)
+	}
+	if name := pickCipherSuite(DefaultCipherSuites, []string{Suite_Aes128Cbc}); name != "" {
+		t.Fatal("默认协商列表不应包含CBC", name)
+	}
+}
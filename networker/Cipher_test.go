@@ -0,0 +1,93 @@
+package networker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testExtData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestExtDataSealOpen(t *testing.T) {
+	key := newAesKeyLen(32)
+	head := []byte("cmd+json ciphertext")
+
+	for _, mode := range []CipherMode{Cipher_AesGcm, Cipher_ChaCha20Poly1305} {
+		for _, n := range []int{0, 1, extChunkSize - 1, extChunkSize, extChunkSize + 1, 3*extChunkSize + 100} {
+			ext := testExtData(n)
+
+			sealed, err := sealExtData([]byte{0xAA}, ext, mode, key, head)
+			if nil != err {
+				t.Fatal(mode, n, err)
+			}
+			if sealed[0] != 0xAA || len(sealed)-1 != sealedExtDataLen(n) {
+				t.Fatal(mode, n, "加密长度错误", len(sealed)-1, sealedExtDataLen(n))
+			}
+
+			plain, err := openExtData(sealed[1:], mode, key, head)
+			if nil != err || !bytes.Equal(plain, ext) {
+				t.Fatal(mode, n, "解密结果错误", err)
+			}
+		}
+	}
+}
+
+func TestExtDataTamper(t *testing.T) {
+	key := newAesKeyLen(32)
+	head := []byte("cmd+json ciphertext")
+	ext := testExtData(2*extChunkSize + 10)
+	chunk := extChunkSize + extTagSize
+
+	seal := func() []byte {
+		sealed, err := sealExtData(nil, ext, Cipher_AesGcm, key, head)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+
+	cases := map[string]func() ([]byte, []byte, []byte){
+		"修改密文": func() ([]byte, []byte, []byte) {
+			data := seal()
+			data[extPrefixSize+100] ^= 1
+			return data, key, head
+		},
+		"修改前缀": func() ([]byte, []byte, []byte) {
+			data := seal()
+			data[0] ^= 1
+			return data, key, head
+		},
+		"截断最后一块": func() ([]byte, []byte, []byte) {
+			data := seal()
+			return data[:extPrefixSize+2*chunk], key, head
+		},
+		"交换块顺序": func() ([]byte, []byte, []byte) {
+			data := seal()
+			first := append([]byte{}, data[extPrefixSize:extPrefixSize+chunk]...)
+			copy(data[extPrefixSize:], data[extPrefixSize+chunk:extPrefixSize+2*chunk])
+			copy(data[extPrefixSize+chunk:], first)
+			return data, key, head
+		},
+		"绑定的帧头不同": func() ([]byte, []byte, []byte) {
+			return seal(), key, []byte("another frame")
+		},
+		"密钥不同": func() ([]byte, []byte, []byte) {
+			return seal(), newAesKeyLen(32), head
+		},
+		"长度不足": func() ([]byte, []byte, []byte) {
+			return seal()[:extPrefixSize+extTagSize-1], key, head
+		},
+	}
+
+	for name, build := range cases {
+		data, k, h := build()
+		if _, err := openExtData(data, Cipher_AesGcm, k, h); err != ErrFrameAuthFailed {
+			t.Fatal(name, "应返回 ErrFrameAuthFailed", err)
+		}
+	}
+}
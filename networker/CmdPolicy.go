@@ -0,0 +1,117 @@
+package networker
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// 命令权限策略：按命令码或命令码范围配置所需角色，请求在交给用户处理程序前检查，
+// 没有权限时回复标准错误，用户处理程序不会收到该请求；
+// 带回复标志但没有 SendAndWait 等待的帧同样检查，没有权限时直接丢弃，不回复
+
+const CmdReason_Forbidden = "forbidden"
+
+// CmdRule 命令码范围 [First, Last] 需要的角色，拥有任意一个即可；Roles为空表示登录用户均可使用
+type CmdRule struct {
+	First uint16
+	Last  uint16
+	Roles []string
+}
+
+// CmdPolicy 命令权限表，多条规则匹配时使用范围最小的一条
+type CmdPolicy struct {
+	DenyUnlisted bool //没有匹配规则的命令是否拒绝，默认允许
+
+	lock  sync.RWMutex
+	rules []CmdRule
+}
+
+func NewCmdPolicy() *CmdPolicy {
+	return &CmdPolicy{}
+}
+
+// Allow 设置单个命令需要的角色
+func (p *CmdPolicy) Allow(cmd uint16, roles ...string) {
+	p.AllowRange(cmd, cmd, roles...)
+}
+
+// AllowCategory 设置命令大分类（如 Cmd_User）下全部命令需要的角色
+func (p *CmdPolicy) AllowCategory(category uint16, roles ...string) {
+	p.AllowRange(category<<3, category<<3|0x07, roles...)
+}
+
+// AllowRange 设置命令码范围需要的角色，相同范围的规则被替换
+func (p *CmdPolicy) AllowRange(first uint16, last uint16, roles ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rule := CmdRule{First: first, Last: last, Roles: roles}
+	for idx := range p.rules {
+		if p.rules[idx].First == first && p.rules[idx].Last == last {
+			p.rules[idx] = rule
+			return
+		}
+	}
+	p.rules = append(p.rules, rule)
+}
+
+// Check 判断用户能否使用命令
+func (p *CmdPolicy) Check(user *LoginUserInfo, cmd uint16) bool {
+	if nil == user {
+		return false
+	}
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var match *CmdRule
+	for idx := range p.rules {
+		rule := &p.rules[idx]
+		if cmd < rule.First || cmd > rule.Last {
+			continue
+		}
+		if nil == match || rule.Last-rule.First < match.Last-match.First {
+			match = rule
+		}
+	}
+
+	if nil == match {
+		return !p.DenyUnlisted
+	}
+	if len(match.Roles) <= 0 {
+		return true
+	}
+
+	for _, role := range match.Roles {
+		if user.HasRole(role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkCmdPolicy 检查对端发来且没有被等待的包的权限，没有权限时返回false；
+// 请求回复错误，带回复标志的包只丢弃，避免双方互相回复
+func (tcp *AesTcpClient) checkCmdPolicy(pkg *AesPackage) bool {
+	if nil == tcp.policy || tcp.policy.Check(tcp.User, pkg.Cmd) {
+		return true
+	}
+
+	name := ""
+	if nil != tcp.User {
+		name = tcp.User.Name
+	}
+	fmt.Println(tcp.ClientFlag, "AesTcpClient 拒绝无权限的命令 user=", name, " Cmd=", pkg.Cmd, " PacSN=", pkg.PacSN)
+	tcp.audit(Audit_CmdDenied, name, CmdReason_Forbidden, strconv.Itoa(int(pkg.Cmd)))
+
+	if pkg.PacSN&0x8000 > 0 {
+		return false
+	}
+
+	rslt := AesCmd{IsOK: false, Msg: "Permission denied", Reason: CmdReason_Forbidden}
+	tcp.ReplyJson(pkg, pkg.Cmd, rslt.ToJson(), nil)
+
+	return false
+}
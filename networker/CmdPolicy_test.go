@@ -0,0 +1,124 @@
+package networker
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testPolicyListener 启动带命令权限表的服务端，口令作为用户的角色
+func testPolicyListener(t *testing.T, audit AuditSink) (int, chan *AesTcpClient) {
+	pol := NewCmdPolicy()
+	pol.AllowCategory(Cmd_User, "admin")
+	pol.Allow(Cmd_QueryUser, "admin", "viewer")
+
+	return testListener(t, func(lsnr *TcpListener) {
+		lsnr.Policy = pol
+		lsnr.Audit = audit
+		lsnr.Authenticator = AuthenticatorFunc(func(ctx context.Context, cred *Credentials) (*LoginUserInfo, error) {
+			return &LoginUserInfo{Name: cred.Name, Roles: []string{cred.Password}}, nil
+		})
+	})
+}
+
+func TestCmdPolicyRequest(t *testing.T) {
+	port, _ := testPolicyListener(t, nil)
+
+	cli := NewAesTcpClient()
+	if !cli.Login("127.0.0.1", port, "v", "viewer", 3000) {
+		t.Fatal("登录失败", cli.GetLastError())
+	}
+	defer cli.Close()
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+
+	cases := []struct {
+		cmd     uint16
+		allowed bool
+	}{
+		{Cmd_QueryUser, true},
+		{Cmd_SaveUser, false},
+		{Cmd_DeleteUser, false},
+		{Cmd_Test, true},
+	}
+	for _, c := range cases {
+		ans, err := cli.SendJsonAndWaitErr(cli.GetNexPacSN(), c.cmd, "q", nil, 3000)
+		if nil != err {
+			t.Fatal(c.cmd, "没有回复", err)
+		}
+		if (ans.Json == "echo:q") != c.allowed {
+			t.Fatal(c.cmd, "权限检查结果错误", ans.Json)
+		}
+		if c.allowed {
+			continue
+		}
+		var rslt AesCmd
+		if err = json.Unmarshal([]byte(ans.Json), &rslt); nil != err || rslt.IsOK || rslt.Reason != CmdReason_Forbidden {
+			t.Fatal(c.cmd, "拒绝原因错误", ans.Json)
+		}
+	}
+}
+
+func TestCmdPolicyReplyBit(t *testing.T) {
+	denied := make(chan *AuditEvent, 4)
+	port, ch := testPolicyListener(t, AuditSinkFunc(func(ev *AuditEvent) {
+		if ev.Type == Audit_CmdDenied {
+			denied <- ev
+		}
+	}))
+
+	cli := NewAesTcpClient()
+	if !cli.Login("127.0.0.1", port, "v", "viewer", 3000) {
+		t.Fatal("登录失败", cli.GetLastError())
+	}
+	defer cli.Close()
+	svr := <-ch
+
+	//服务端记录交给处理程序的包，请求照常回显
+	got := make(chan uint16, 4)
+	svr.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {
+		got <- pkg.Cmd
+		if pkg.PacSN&0x8000 <= 0 {
+			tcp.ReplyJson(pkg, pkg.Cmd, "echo:"+pkg.Json, nil)
+		}
+	})
+	//客户端不应收到被拒绝的回复包的回复
+	answered := make(chan uint16, 4)
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {
+		answered <- pkg.Cmd
+	})
+
+	//没有被等待的回复包：无权限的被丢弃，有权限的交给处理程序
+	cli.SendJson(0x8000|cli.GetNexPacSN(), Cmd_SaveUser, "forged", nil)
+	cli.SendJson(0x8000|cli.GetNexPacSN(), Cmd_QueryUser, "allowed", nil)
+	if _, err := cli.SendJsonAndWaitErr(cli.GetNexPacSN(), Cmd_Test, "sync", nil, 3000); nil != err {
+		t.Fatal("请求失败", err)
+	}
+
+	for _, want := range []uint16{Cmd_QueryUser, Cmd_Test} {
+		select {
+		case cmd := <-got:
+			if cmd != want {
+				t.Fatal("处理程序收到", cmd, "期望", want)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("处理程序没有收到", want)
+		}
+	}
+
+	select {
+	case ev := <-denied:
+		if ev.User != "v" || ev.Detail != strconv.Itoa(Cmd_SaveUser) {
+			t.Fatal("审计事件错误", ev)
+		}
+	default:
+		t.Fatal("没有输出权限拒绝事件")
+	}
+
+	select {
+	case cmd := <-answered:
+		t.Fatal("被拒绝的回复包收到了回复", cmd)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,114 @@
+package networker
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync/atomic"
+)
+
+// 数据压缩：协商了 Cap_Compress 时，cmd+Json不小于阈值的数据帧在加密前用DEFLATE压缩，
+// 压缩后变小时使用，JSON段长度写为0xFFFE + 4字节实际长度表示本帧已压缩。ExtData不压缩
+
+// DefaultCompressThreshold 默认压缩阈值（cmd+Json字节数）
+const DefaultCompressThreshold = 512
+
+// CompressionStats 连接的压缩统计，Raw为压缩前的cmd+Json字节数，Wire为实际传输的字节数（未压缩的帧两者相同）
+type CompressionStats struct {
+	SentRaw        uint64
+	SentWire       uint64
+	SentCompressed uint64 //压缩发送的帧数
+	RecvRaw        uint64
+	RecvWire       uint64
+	RecvCompressed uint64 //收到的压缩帧数
+}
+
+// SendRatio 发送方向的压缩比（压缩前/压缩后），没有数据时为1
+func (s CompressionStats) SendRatio() float64 {
+	return compressionRatio(s.SentRaw, s.SentWire)
+}
+
+// RecvRatio 接收方向的压缩比（解压后/解压前），没有数据时为1
+func (s CompressionStats) RecvRatio() float64 {
+	return compressionRatio(s.RecvRaw, s.RecvWire)
+}
+
+func compressionRatio(raw uint64, wire uint64) float64 {
+	if 0 == wire {
+		return 1
+	}
+
+	return float64(raw) / float64(wire)
+}
+
+// compressCounters 连接的压缩计数
+type compressCounters struct {
+	sentRaw, sentWire, sentCompressed atomic.Uint64
+	recvRaw, recvWire, recvCompressed atomic.Uint64
+}
+
+func (c *compressCounters) reset() {
+	c.sentRaw.Store(0)
+	c.sentWire.Store(0)
+	c.sentCompressed.Store(0)
+	c.recvRaw.Store(0)
+	c.recvWire.Store(0)
+	c.recvCompressed.Store(0)
+}
+
+// GetCompressionStats 连接的压缩统计
+func (tcp *AesTcpClient) GetCompressionStats() CompressionStats {
+	c := &tcp.zipCount
+	return CompressionStats{
+		SentRaw:        c.sentRaw.Load(),
+		SentWire:       c.sentWire.Load(),
+		SentCompressed: c.sentCompressed.Load(),
+		RecvRaw:        c.recvRaw.Load(),
+		RecvWire:       c.recvWire.Load(),
+		RecvCompressed: c.recvCompressed.Load(),
+	}
+}
+
+// compressThreshold 发送时的压缩阈值，未协商压缩时为0
+func (tcp *AesTcpClient) compressThreshold() int {
+	if !tcp.codec.caps.Has(Cap_Compress) {
+		return 0
+	}
+	if tcp.CompressThreshold > 0 {
+		return tcp.CompressThreshold
+	}
+
+	return DefaultCompressThreshold
+}
+
+// deflateBody 压缩数据，压缩后没有变小时返回nil
+func deflateBody(body []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if nil != err {
+		return nil
+	}
+
+	w.Write(body)
+	if nil != w.Close() || buf.Len() >= len(body) {
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+// inflateBody 解压数据，解压后超过limit字节时返回 ErrJsonTooLarge
+func inflateBody(data []byte, limit uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if nil != err {
+		return nil, ErrBadFrame
+	}
+	if uint64(len(body)) > uint64(limit) {
+		return nil, ErrJsonTooLarge
+	}
+
+	return body, nil
+}
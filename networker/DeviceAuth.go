@@ -0,0 +1,149 @@
+package networker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+
+	ecies "github.com/ecies/go/v2"
+)
+
+// 设备公钥认证：设备没有人工输入口令，每个设备持有自己的ECC密钥对
+// 服务端在 Cmd_GetUserNamePwd 中下发随机挑战，客户端用设备私钥对设备名、挑战和会话绑定值签名，
+// 服务端通过 OnGetDeviceKey 查找登记的设备公钥校验签名；签名绑定本次会话，无法转发到其他连接使用
+
+const authNameDevice = "device-key"
+
+// deviceSignData 设备签名的内容
+func deviceSignData(name string, nonce string, cbind []byte) []byte {
+	return []byte("networker device auth:" + name + ":" + nonce + ":" + hex.EncodeToString(cbind))
+}
+
+// DeviceEntry 登记的设备公钥
+type DeviceEntry struct {
+	PubKey  string `json:"pubkey"`            //压缩公钥十六进制
+	Revoked bool   `json:"revoked,omitempty"` //已吊销的设备密钥不能再登录
+}
+
+// DeviceStore 登记的设备公钥存储，可保存为JSON文件
+type DeviceStore struct {
+	lock    sync.RWMutex
+	devices map[string]*DeviceEntry
+}
+
+func NewDeviceStore() *DeviceStore {
+	return &DeviceStore{devices: make(map[string]*DeviceEntry)}
+}
+
+// LoadDeviceStore 从JSON文件加载设备公钥
+func LoadDeviceStore(path string) (*DeviceStore, error) {
+	data, err := os.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+
+	store := NewDeviceStore()
+	err = json.Unmarshal(data, &store.devices)
+	if nil != err {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Save 保存设备公钥到JSON文件
+func (store *DeviceStore) Save(path string) error {
+	store.lock.RLock()
+	data, err := json.MarshalIndent(store.devices, "", "\t")
+	store.lock.RUnlock()
+
+	if nil != err {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// Register 登记设备公钥，已有的登记（包括吊销状态）被替换
+func (store *DeviceStore) Register(name string, pubKey *ecies.PublicKey) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if nil == store.devices {
+		store.devices = make(map[string]*DeviceEntry)
+	}
+	store.devices[name] = &DeviceEntry{PubKey: pubKey.Hex(true)}
+}
+
+// Revoke 吊销设备密钥，设备不存在时返回false
+func (store *DeviceStore) Revoke(name string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	dev, has := store.devices[name]
+	if !has {
+		return false
+	}
+	dev.Revoked = true
+
+	return true
+}
+
+// Get 获取设备公钥，设备不存在或已吊销时返回nil，可直接用作 TcpListener.OnGetDeviceKey
+func (store *DeviceStore) Get(name string) *ecies.PublicKey {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	dev, has := store.devices[name]
+	if !has || dev.Revoked {
+		return nil
+	}
+
+	pubKey, err := ecies.NewPublicKeyFromHex(dev.PubKey)
+	if nil != err {
+		return nil
+	}
+
+	return pubKey
+}
+
+func (store *DeviceStore) Delete(name string) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.devices, name)
+}
+
+// 服务端校验设备签名，成功时返回设备公钥指纹
+func (ptc *AesTcpClient) deviceAuthorize(lsn *TcpListener, name string, nonce string, sigHex string) (string, bool) {
+	pubKey := lsn.OnGetDeviceKey(name)
+	if nil == pubKey {
+		return "", false
+	}
+
+	sig, err := hex.DecodeString(sigHex)
+	if nil != err {
+		return "", false
+	}
+
+	if !VerifySign(pubKey, deviceSignData(name, nonce, ptc.cbind), sig) {
+		return "", false
+	}
+
+	return Fingerprint(pubKey), true
+}
+
+// deviceKeyValid 设备公钥是否仍然登记有效且指纹一致
+func deviceKeyValid(lsn *TcpListener, name string, fingerprint string) bool {
+	if nil == lsn.OnGetDeviceKey {
+		return false
+	}
+
+	pubKey := lsn.OnGetDeviceKey(name)
+	if nil == pubKey {
+		return false
+	}
+
+	return Fingerprint(pubKey) == fingerprint
+}
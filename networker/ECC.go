@@ -1,11 +1,25 @@
 package networker
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
 	ecies "github.com/ecies/go/v2"
 )
 
+// pemTypeEccKey 私钥文件的PEM类型，内容为32字节secp256k1私钥
+const pemTypeEccKey = "SECP256K1 PRIVATE KEY"
+
+var ErrBadEccKey = errors.New("invalid ECC private key")
+
 type ECC struct {
 	EccKey *ecies.PrivateKey
 }
@@ -49,3 +63,114 @@ func (ecc *ECC) Decrypt(data []byte) []byte {
 
 	return code
 }
+
+// Sign 使用私钥对数据的SHA-256摘要进行ECDSA签名（ASN.1格式）
+func (ecc *ECC) Sign(data []byte) []byte {
+	ecc.initKey()
+
+	priv := ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: ecc.EccKey.Curve, X: ecc.EccKey.X, Y: ecc.EccKey.Y},
+		D:         ecc.EccKey.D,
+	}
+
+	hash := sha256.Sum256(data)
+	sig, err := ecdsa.SignASN1(rand.Reader, &priv, hash[:])
+	if nil != err {
+		fmt.Println("ECC.Sign 签名异常", err)
+		return nil
+	}
+
+	return sig
+}
+
+// VerifySign 使用公钥校验 Sign 生成的签名
+func VerifySign(pubKey *ecies.PublicKey, data []byte, sig []byte) bool {
+	if nil == pubKey || len(sig) <= 0 {
+		return false
+	}
+
+	pub := ecdsa.PublicKey{Curve: pubKey.Curve, X: pubKey.X, Y: pubKey.Y}
+	hash := sha256.Sum256(data)
+
+	return ecdsa.VerifyASN1(&pub, hash[:], sig)
+}
+
+// Fingerprint 公钥指纹：压缩公钥的SHA-256十六进制字符串
+func Fingerprint(pubKey *ecies.PublicKey) string {
+	hash := sha256.Sum256(pubKey.Bytes(true))
+	return hex.EncodeToString(hash[:])
+}
+
+// ParseECC 解析PEM格式或十六进制字符串格式的私钥
+func ParseECC(data []byte) (*ECC, error) {
+	var raw []byte
+	if block, _ := pem.Decode(data); nil != block {
+		if block.Type != pemTypeEccKey {
+			return nil, ErrBadEccKey
+		}
+		raw = block.Bytes
+	} else {
+		var err error
+		raw, err = hex.DecodeString(strings.TrimSpace(string(data)))
+		if nil != err {
+			return nil, ErrBadEccKey
+		}
+	}
+
+	return eccFromRaw(raw)
+}
+
+// eccFromRaw 由32字节私钥创建ECC
+func eccFromRaw(raw []byte) (*ECC, error) {
+	if len(raw) != 32 || bytes.Equal(raw, make([]byte, 32)) {
+		return nil, ErrBadEccKey
+	}
+
+	return &ECC{EccKey: ecies.NewPrivateKeyFromBytes(raw)}, nil
+}
+
+// LoadECC 从文件加载私钥，文件可以是PEM格式或十六进制字符串
+func LoadECC(path string) (*ECC, error) {
+	data, err := os.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+
+	return ParseECC(data)
+}
+
+// LoadOrCreateECC 从文件加载私钥，文件不存在时生成新私钥并保存
+func LoadOrCreateECC(path string) (*ECC, error) {
+	ecc, err := LoadECC(path)
+	if nil == err || !os.IsNotExist(err) {
+		return ecc, err
+	}
+
+	ecc = &ECC{}
+	ecc.initKey()
+	if nil == ecc.EccKey {
+		return nil, ErrBadEccKey
+	}
+
+	err = ecc.Save(path)
+	if nil != err {
+		return nil, err
+	}
+
+	return ecc, nil
+}
+
+// MarshalPEM 私钥的PEM编码，headers可为nil
+func (ecc *ECC) MarshalPEM(headers map[string]string) []byte {
+	ecc.initKey()
+
+	raw := make([]byte, 32)
+	ecc.EccKey.D.FillBytes(raw)
+
+	return pem.EncodeToMemory(&pem.Block{Type: pemTypeEccKey, Headers: headers, Bytes: raw})
+}
+
+// Save 以PEM格式保存私钥，文件只允许当前用户读写
+func (ecc *ECC) Save(path string) error {
+	return os.WriteFile(path, ecc.MarshalPEM(nil), 0600)
+}
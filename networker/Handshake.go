@@ -0,0 +1,104 @@
+package networker
+
+import "encoding/json"
+
+// 密钥交换方式：旧版由客户端生成AES密钥并用服务端临时公钥ECIES加密；
+// ECDH方式双方各出临时公钥，由共享密钥和握手记录经HKDF派生两个方向的密钥
+const kexNameEcdh = "ecdh"
+
+// HandshakeExt 握手扩展字段，旧版本对端会忽略此字段
+type HandshakeExt struct {
+	Ciphers []string   `json:"ciphers,omitempty"`   //服务端提供的加密模式
+	Cipher  string     `json:"cipher,omitempty"`    //客户端选定的加密模式
+	Nego    bool       `json:"suitenego,omitempty"` //服务端支持加密套件协商
+	Suites  []string   `json:"suites,omitempty"`    //客户端支持的加密套件，按优先顺序
+	ExtEnc  bool       `json:"extenc,omitempty"`    //ExtData加密：服务端表示支持，客户端表示启用
+	Seq     bool       `json:"seq,omitempty"`       //防重放序号：服务端表示支持，客户端表示启用
+	Rekey   bool       `json:"rekey,omitempty"`     //会话中更换密钥：服务端表示支持，客户端表示启用
+	Kexs    []string   `json:"kexs,omitempty"`      //服务端提供的密钥交换方式
+	Kex     string     `json:"kex,omitempty"`       //客户端选定的密钥交换方式
+	IdKey   string     `json:"idkey,omitempty"`     //服务端长期身份公钥
+	IdSign  string     `json:"idsign,omitempty"`    //身份私钥对本次临时公钥和握手扩展的签名
+	IdAlts  []idProof  `json:"idalts,omitempty"`    //轮换过渡期内的旧身份公钥及签名
+	Auths   []string   `json:"auths,omitempty"`     //服务端支持的认证方式
+	Auth    string     `json:"auth,omitempty"`      //客户端选定的认证方式
+	Nonce   string     `json:"nonce,omitempty"`     //服务端下发的设备认证挑战
+	Ver     uint16     `json:"ver,omitempty"`       //协议版本：服务端为支持的最高版本，客户端为选定的版本
+	Finish  string     `json:"finish,omitempty"`    //服务端对密钥交换握手记录的确认码，在第一条加密消息中发送
+	Caps    Capability `json:"caps,omitempty"`      //功能位图：服务端为支持的功能，客户端为启用的功能
+}
+
+// idProof 身份公钥及其对临时公钥的签名
+type idProof struct {
+	Key  string `json:"key"`
+	Sign string `json:"sign"`
+}
+
+func (ext *HandshakeExt) hasCipher(name string) bool {
+	if nil == ext {
+		return false
+	}
+
+	for _, c := range ext.Ciphers {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ext *HandshakeExt) hasKex(name string) bool {
+	if nil == ext {
+		return false
+	}
+
+	for _, k := range ext.Kexs {
+		if k == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ext *HandshakeExt) hasAuth(name string) bool {
+	if nil == ext {
+		return false
+	}
+
+	for _, a := range ext.Auths {
+		if a == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ext *HandshakeExt) getNonce() string {
+	if nil == ext {
+		return ""
+	}
+
+	return ext.Nonce
+}
+
+// serverKeySignData 服务端身份签名的内容：临时公钥和除签名外的全部扩展字段，
+// 中间人删除或修改服务端提供的功能会导致签名校验失败
+func serverKeySignData(ephemeralHex string, ext *HandshakeExt) []byte {
+	var offer HandshakeExt
+	if nil != ext {
+		offer = *ext
+	}
+	offer.IdKey, offer.IdSign, offer.IdAlts = "", "", nil
+
+	jdata, _ := json.Marshal(&offer)
+	return []byte("networker server key:" + ephemeralHex + "\n" + string(jdata))
+}
+
+// handshakeFinishMac 服务端对密钥交换握手记录的确认码，由会话绑定值计算，
+// 客户端据此确认服务端收到的回复和自己收到的首条消息都未被修改
+func handshakeFinishMac(cbind []byte, transcript []byte) []byte {
+	return hkdfExpand(cbind, transcript, "networker handshake finished", 32)
+}
@@ -0,0 +1,99 @@
+package networker
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// testWire 记录客户端发往服务端的原始数据
+type testWire struct {
+	lock sync.Mutex
+	data bytes.Buffer
+}
+
+func (w *testWire) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.data.Write(p)
+}
+
+func (w *testWire) contains(text string) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return bytes.Contains(w.data.Bytes(), []byte(text))
+}
+
+// testRelay 在本机随机端口转发一个连接到port，返回转发端口和记录的数据
+func testRelay(t *testing.T, port int) (int, *testWire) {
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lsn.Close() })
+
+	wire := &testWire{}
+	go func() {
+		src, err := lsn.Accept()
+		if nil != err {
+			return
+		}
+		dst, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if nil != err {
+			src.Close()
+			return
+		}
+		t.Cleanup(func() { src.Close(); dst.Close() })
+
+		go io.Copy(src, dst)
+		io.Copy(io.MultiWriter(dst, wire), src)
+	}()
+
+	return lsn.Addr().(*net.TCPAddr).Port, wire
+}
+
+func TestEcdhLogin(t *testing.T) {
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.EnableEcdh = true
+	})
+
+	cli := NewAesTcpClient()
+	cli.EnableEcdh = true
+	relay, wire := testRelay(t, port)
+	testLogin(t, cli, relay)
+	svr := <-ch
+	if !wire.contains(`"kex":"ecdh"`) {
+		t.Fatal("没有使用ECDH密钥交换")
+	}
+
+	//两个方向使用不同的密钥
+	cli.keyLock.RLock()
+	svr.keyLock.RLock()
+	sendKey, recvKey, svrRecv := string(cli.aesKey), string(cli.recvAesKey), string(svr.recvAesKey)
+	svr.keyLock.RUnlock()
+	cli.keyLock.RUnlock()
+	if sendKey != svrRecv || sendKey == recvKey {
+		t.Fatal("双方派生的密钥错误")
+	}
+
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	for _, n := range []int{0, 200000} {
+		testEcho(t, cli, n)
+	}
+
+	//不支持ECDH的客户端使用旧的密钥交换方式
+	legacy := NewAesTcpClient()
+	relay, wire = testRelay(t, port)
+	testLogin(t, legacy, relay)
+	<-ch
+	if wire.contains(`"kex":"ecdh"`) {
+		t.Fatal("未启用ECDH的客户端选择了ECDH")
+	}
+	legacy.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	testEcho(t, legacy, 100)
+}
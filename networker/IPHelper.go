@@ -83,3 +83,13 @@ func GetLocalIPv4() []net.IPNet {
 
 	return ipv4
 }
+
+// RemoteIP 连接对端的IP地址（不含端口）
+func RemoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if nil != err {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
@@ -0,0 +1,146 @@
+package networker
+
+import (
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// 服务端身份密钥轮换：生成新密钥后旧密钥在过渡期内继续保留，
+// 握手时用新旧密钥分别签名临时公钥并一起发送，已固定旧密钥指纹的客户端在过渡期内仍可连接，
+// 使用 KnownServers 的客户端会把记录更新为新密钥
+
+// pemHeaderExpires 旧密钥文件中记录过渡期结束时间的PEM头
+const pemHeaderExpires = "Expires"
+
+type retiredKey struct {
+	key     *ECC
+	expires time.Time
+}
+
+// IdentityKeyRing 服务端身份密钥及过渡期内的旧密钥
+type IdentityKeyRing struct {
+	Path string //当前密钥文件，旧密钥保存在 Path+".old"；为空时不保存
+
+	lock    sync.RWMutex
+	current *ECC
+	retired []retiredKey
+}
+
+func NewIdentityKeyRing(key *ECC) *IdentityKeyRing {
+	return &IdentityKeyRing{current: key}
+}
+
+// LoadIdentityKeyRing 从文件加载身份密钥，文件不存在时生成并保存；同时加载未过期的旧密钥
+func LoadIdentityKeyRing(path string) (*IdentityKeyRing, error) {
+	key, err := LoadOrCreateECC(path)
+	if nil != err {
+		return nil, err
+	}
+
+	ring := &IdentityKeyRing{Path: path, current: key}
+
+	data, err := os.ReadFile(path + ".old")
+	if nil != err {
+		if !os.IsNotExist(err) {
+			fmt.Println("IdentityKeyRing 读取旧密钥异常", err)
+		}
+		return ring, nil
+	}
+
+	for block, rest := pem.Decode(data); nil != block; block, rest = pem.Decode(rest) {
+		expires, err := time.Parse(time.RFC3339, block.Headers[pemHeaderExpires])
+		if nil != err || time.Now().After(expires) || block.Type != pemTypeEccKey {
+			continue
+		}
+
+		old, err := eccFromRaw(block.Bytes)
+		if nil != err {
+			fmt.Println("IdentityKeyRing 旧密钥格式错误", err)
+			continue
+		}
+		ring.retired = append(ring.retired, retiredKey{key: old, expires: expires})
+	}
+
+	return ring, nil
+}
+
+// Current 当前身份密钥
+func (ring *IdentityKeyRing) Current() *ECC {
+	ring.lock.RLock()
+	defer ring.lock.RUnlock()
+
+	return ring.current
+}
+
+// Keys 当前密钥和过渡期内的旧密钥，当前密钥在前
+func (ring *IdentityKeyRing) Keys() []*ECC {
+	ring.lock.RLock()
+	defer ring.lock.RUnlock()
+
+	keys := []*ECC{ring.current}
+	now := time.Now()
+	for _, old := range ring.retired {
+		if now.Before(old.expires) {
+			keys = append(keys, old.key)
+		}
+	}
+
+	return keys
+}
+
+// Rotate 生成新身份密钥，当前密钥在overlap时长内继续使用；设置了Path时保存新旧密钥
+func (ring *IdentityKeyRing) Rotate(overlap time.Duration) (*ECC, error) {
+	key := &ECC{}
+	key.initKey()
+	if nil == key.EccKey {
+		return nil, ErrBadEccKey
+	}
+
+	return key, ring.RotateTo(key, overlap)
+}
+
+// RotateTo 使用指定的新身份密钥，当前密钥在overlap时长内继续使用
+func (ring *IdentityKeyRing) RotateTo(key *ECC, overlap time.Duration) error {
+	if nil == key || nil == key.EccKey {
+		return ErrBadEccKey
+	}
+
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+
+	now := time.Now()
+	retired := make([]retiredKey, 0, len(ring.retired)+1)
+	if nil != ring.current && overlap > 0 {
+		retired = append(retired, retiredKey{key: ring.current, expires: now.Add(overlap)})
+	}
+	for _, old := range ring.retired {
+		if now.Before(old.expires) {
+			retired = append(retired, old)
+		}
+	}
+
+	if len(ring.Path) > 0 {
+		//先保存旧密钥，保存新密钥失败时旧密钥文件仍可用
+		var data []byte
+		for _, old := range retired {
+			data = append(data, old.key.MarshalPEM(map[string]string{pemHeaderExpires: old.expires.UTC().Format(time.RFC3339)})...)
+		}
+		err := os.WriteFile(ring.Path+".old", data, 0600)
+		if nil != err {
+			return err
+		}
+
+		err = key.Save(ring.Path)
+		if nil != err {
+			return err
+		}
+	}
+
+	ring.current = key
+	ring.retired = retired
+
+	return nil
+}
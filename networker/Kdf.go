@@ -0,0 +1,66 @@
+package networker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sessionKeys 一代会话密钥，发送和接收方向分开
+type sessionKeys struct {
+	send []byte
+	recv []byte
+}
+
+// 同一个密钥用于两个方向（旧版ECIES密钥交换）
+func symmetricKeys(key []byte) sessionKeys {
+	return sessionKeys{send: key, recv: key}
+}
+
+// hkdfExpand 使用HKDF-SHA256从共享密钥派生指定用途的密钥
+func hkdfExpand(secret []byte, salt []byte, info string, keyLen int) []byte {
+	key := make([]byte, keyLen)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	if nil != err {
+		return nil
+	}
+
+	return key
+}
+
+// deriveSessionKeys 派生客户端到服务端、服务端到客户端两个方向的密钥
+func deriveSessionKeys(secret []byte, salt []byte, keyLen int, isServer bool) sessionKeys {
+	c2s := hkdfExpand(secret, salt, "networker c2s", keyLen)
+	s2c := hkdfExpand(secret, salt, "networker s2c", keyLen)
+
+	if isServer {
+		return sessionKeys{send: s2c, recv: c2s}
+	}
+	return sessionKeys{send: c2s, recv: s2c}
+}
+
+// transcriptHash 握手记录摘要：服务端首条消息 + 客户端回复，每条消息带长度前缀
+func transcriptHash(msgs ...string) []byte {
+	h := sha256.New()
+	for _, msg := range msgs {
+		binary.Write(h, binary.BigEndian, uint32(len(msg)))
+		h.Write([]byte(msg))
+	}
+
+	return h.Sum(nil)
+}
+
+// setEciesKey 旧版密钥交换：客户端生成的密钥用于两个方向
+func (tcp *AesTcpClient) setEciesKey(key []byte) {
+	cbind := sha256.Sum256(key)
+	tcp.cbind = cbind[:]
+	tcp.setSessionKeys(symmetricKeys(key))
+}
+
+// setDerivedKeys ECDH或PSK密钥交换：由共享密钥和握手记录派生两个方向的密钥
+func (tcp *AesTcpClient) setDerivedKeys(secret []byte, transcript []byte, keyLen int) {
+	tcp.cbind = hkdfExpand(secret, transcript, "networker binding", sha256.Size)
+	tcp.setSessionKeys(deriveSessionKeys(secret, transcript, keyLen, tcp.isServer))
+}
@@ -0,0 +1,169 @@
+package networker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrServerKeyMismatch = errors.New("server identity key does not match")
+	ErrServerNotVerified = errors.New("server did not provide a verifiable identity")
+	ErrKnownServersFull  = errors.New("too many known servers")
+)
+
+// maxKnownServers 记录数上限，达到后不再首次信任新的地址
+const maxKnownServers = 4096
+
+// KnownServers 首次信任（TOFU）的服务端身份记录
+// 文件每行格式：地址 指纹，例如 "127.0.0.1:5868 3f2a..."
+type KnownServers struct {
+	Path string
+
+	lock    sync.Mutex
+	servers map[string]string
+}
+
+func NewKnownServers(path string) *KnownServers {
+	ks := &KnownServers{Path: path}
+	ks.load()
+
+	return ks
+}
+
+func (ks *KnownServers) load() {
+	ks.servers = make(map[string]string)
+
+	if len(ks.Path) <= 0 {
+		return
+	}
+
+	file, err := os.Open(ks.Path)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			fmt.Println("KnownServers.load 读取文件异常", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		ks.servers[fields[0]] = strings.ToLower(fields[1])
+	}
+}
+
+func (ks *KnownServers) save() error {
+	if len(ks.Path) <= 0 {
+		return nil
+	}
+
+	var sb strings.Builder
+	for addr, fp := range ks.servers {
+		sb.WriteString(addr + " " + fp + "\n")
+	}
+
+	return os.WriteFile(ks.Path, []byte(sb.String()), 0600)
+}
+
+// Check 校验服务端指纹：未知服务端记录并信任，已知服务端指纹不一致返回 ErrServerKeyMismatch
+// previous为服务端轮换过渡期内的旧密钥指纹，记录与其中之一相同时更新为新指纹
+func (ks *KnownServers) Check(addr string, fingerprint string, previous ...string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if nil == ks.servers {
+		ks.load()
+	}
+
+	fingerprint = strings.ToLower(fingerprint)
+	known, has := ks.servers[addr]
+	if has {
+		if known == fingerprint {
+			return nil
+		}
+
+		rotated := false
+		for _, fp := range previous {
+			if strings.EqualFold(known, fp) {
+				rotated = true
+				break
+			}
+		}
+		if !rotated {
+			return ErrServerKeyMismatch
+		}
+	} else if len(ks.servers) >= maxKnownServers {
+		return ErrKnownServersFull
+	}
+
+	ks.servers[addr] = fingerprint
+	err := ks.save()
+	if nil != err {
+		fmt.Println("KnownServers.Check 保存文件异常", err)
+	}
+
+	return nil
+}
+
+// Get 获取已记录的服务端指纹
+func (ks *KnownServers) Get(addr string) (string, bool) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	fp, has := ks.servers[addr]
+	return fp, has
+}
+
+// Add 预先登记身份指纹，已有的地址被覆盖
+func (ks *KnownServers) Add(addr string, fingerprint string) error {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if nil == ks.servers {
+		ks.load()
+	}
+	if _, has := ks.servers[addr]; !has && len(ks.servers) >= maxKnownServers {
+		return ErrKnownServersFull
+	}
+
+	ks.servers[addr] = strings.ToLower(fingerprint)
+	return ks.save()
+}
+
+// HasFingerprint 指纹是否已记录（任意地址），用于只接受预先登记身份的场合
+func (ks *KnownServers) HasFingerprint(fingerprint string) bool {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	if nil == ks.servers {
+		ks.load()
+	}
+
+	for _, fp := range ks.servers {
+		if strings.EqualFold(fp, fingerprint) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remove 删除服务端记录（服务端更换密钥后使用）
+func (ks *KnownServers) Remove(addr string) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	delete(ks.servers, addr)
+	err := ks.save()
+	if nil != err {
+		fmt.Println("KnownServers.Remove 保存文件异常", err)
+	}
+}
@@ -0,0 +1,394 @@
+package networker
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 登录防暴力破解：分别按来源IP和用户名统计连续认证失败次数，
+// 失败后延迟回复认证结果（每次失败延迟加倍），失败次数达到上限时临时锁定
+// 校验凭据前登记进行中的尝试，进行中的尝试和已失败次数合计达到上限时不再接受新的尝试，
+// 多个并行连接不能在锁定生效前同时猜测
+// 计数表按最近使用排序，超过上限时淘汰最久未使用的记录；不存在的用户名只按来源IP统计，不保留用户名记录
+
+var ErrLoginLocked = errors.New("too many failed logins, temporarily locked")
+
+const (
+	LockKindIP   = "ip"
+	LockKindUser = "user"
+)
+
+// lockEvent 一次失败触发的锁定
+type lockEvent struct {
+	kind, key string
+	failures  int
+}
+
+// maxGuardEntries 每个计数表的记录上限
+const maxGuardEntries = 4096
+
+type guardEntry struct {
+	key         string
+	failures    int
+	pending     int //进行中的认证尝试
+	lastFail    time.Time
+	lockedUntil time.Time
+}
+
+// idle 没有进行中的尝试、失败计数已过期且未锁定，记录可以删除
+func (e *guardEntry) idle(lockTime time.Duration) bool {
+	return e.pending <= 0 && time.Since(e.lastFail) >= lockTime && time.Now().After(e.lockedUntil)
+}
+
+// guardTable 计数记录表，order按最近使用排序（Front为最近），超过上限时从最久未使用的一端淘汰
+type guardTable struct {
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// get 获取计数记录并标记为最近使用，计数已过期时清零，调用方需持有lock
+func (t *guardTable) get(key string, create bool, lockTime time.Duration) *guardEntry {
+	if nil == t.entries {
+		t.entries = make(map[string]*list.Element)
+		t.order = list.New()
+	}
+
+	if el, has := t.entries[key]; has {
+		e := el.Value.(*guardEntry)
+		if !e.idle(lockTime) {
+			t.order.MoveToFront(el)
+			return e
+		}
+		t.remove(el)
+	}
+	if !create {
+		return nil
+	}
+
+	if t.order.Len() >= maxGuardEntries {
+		t.evict()
+	}
+	e := &guardEntry{key: key}
+	t.entries[key] = t.order.PushFront(e)
+
+	return e
+}
+
+// lookup 获取计数记录，不改变使用顺序，调用方需持有lock
+func (t *guardTable) lookup(key string) *guardEntry {
+	if el, has := t.entries[key]; has {
+		return el.Value.(*guardEntry)
+	}
+
+	return nil
+}
+
+func (t *guardTable) remove(el *list.Element) {
+	delete(t.entries, el.Value.(*guardEntry).key)
+	t.order.Remove(el)
+}
+
+// evict 淘汰最久未使用且没有进行中尝试的记录，调用方需持有lock
+func (t *guardTable) evict() {
+	for el := t.order.Back(); nil != el; el = el.Prev() {
+		if el.Value.(*guardEntry).pending <= 0 {
+			t.remove(el)
+			return
+		}
+	}
+}
+
+// release 结束一次进行中的尝试，记录不再需要时删除，调用方需持有lock
+func (t *guardTable) release(key string, lockTime time.Duration) {
+	el, has := t.entries[key]
+	if !has {
+		return
+	}
+
+	e := el.Value.(*guardEntry)
+	if e.pending > 0 {
+		e.pending--
+	}
+	if e.idle(lockTime) {
+		t.remove(el)
+	}
+}
+
+// LoginGuard 认证失败计数与锁定，零值字段使用默认值
+type LoginGuard struct {
+	MaxFailures int           //连续失败次数达到该值时锁定，默认5
+	BaseDelay   time.Duration //第一次失败后的回复延迟，之后每次失败加倍，默认500ms
+	MaxDelay    time.Duration //回复延迟上限，默认8s
+	LockTime    time.Duration //锁定时长，也是失败计数的清零时间，默认15分钟
+	Whitelist   []string      //不做统计和锁定的IP或CIDR网段
+
+	//锁定事件回调，kind为 LockKindIP 或 LockKindUser，key为IP或用户名
+	OnLockout func(kind string, key string, failures int)
+
+	lock     sync.Mutex
+	ips      guardTable
+	users    guardTable
+	lockouts atomic.Uint64
+}
+
+func NewLoginGuard() *LoginGuard {
+	return &LoginGuard{}
+}
+
+func (g *LoginGuard) maxFailures() int {
+	if g.MaxFailures <= 0 {
+		return 5
+	}
+	return g.MaxFailures
+}
+
+func (g *LoginGuard) lockTime() time.Duration {
+	if g.LockTime <= 0 {
+		return 15 * time.Minute
+	}
+	return g.LockTime
+}
+
+// GetLockoutCount 累计锁定次数
+func (g *LoginGuard) GetLockoutCount() uint64 {
+	return g.lockouts.Load()
+}
+
+// IsWhitelisted 判断IP是否在白名单中
+func (g *LoginGuard) IsWhitelisted(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, item := range g.Whitelist {
+		if item == ip {
+			return true
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if nil == err && nil != addr && ipNet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckIP 来源IP被锁定时返回 ErrLoginLocked
+func (g *LoginGuard) CheckIP(ip string) error {
+	if g.IsWhitelisted(ip) {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	e := g.ips.get(ip, false, g.lockTime())
+	if nil != e && time.Now().Before(e.lockedUntil) {
+		return ErrLoginLocked
+	}
+
+	return nil
+}
+
+// CheckUser 用户名被锁定时返回 ErrLoginLocked，白名单IP不受用户锁定限制
+func (g *LoginGuard) CheckUser(ip string, name string) error {
+	if g.IsWhitelisted(ip) {
+		return nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	e := g.users.get(name, false, g.lockTime())
+	if nil != e && time.Now().Before(e.lockedUntil) {
+		return ErrLoginLocked
+	}
+
+	return nil
+}
+
+// Fail 记录一次认证失败，返回回复认证结果前应等待的时间
+func (g *LoginGuard) Fail(ip string, name string) time.Duration {
+	delay, _ := g.fail(ip, name)
+	return delay
+}
+
+// fail 记录一次认证失败，同时返回本次失败触发的锁定
+func (g *LoginGuard) fail(ip string, name string) (time.Duration, []lockEvent) {
+	return g.record(ip, name, false, true)
+}
+
+// record 记录一次认证失败，attempt为true时同时结束进行中的尝试；
+// knownUser为false时（用户不存在）只按来源IP统计，不保留用户名记录
+func (g *LoginGuard) record(ip string, name string, attempt bool, knownUser bool) (time.Duration, []lockEvent) {
+	if g.IsWhitelisted(ip) {
+		return 0, nil
+	}
+
+	var events []lockEvent
+	failures := 0
+
+	g.lock.Lock()
+	count := func(table *guardTable, kind string, key string) {
+		if len(key) <= 0 {
+			return
+		}
+
+		e := table.get(key, true, g.lockTime())
+		if attempt && e.pending > 0 {
+			e.pending--
+		}
+		e.failures++
+		e.lastFail = time.Now()
+		if e.failures%g.maxFailures() == 0 {
+			e.lockedUntil = e.lastFail.Add(g.lockTime())
+			events = append(events, lockEvent{kind, key, e.failures})
+		}
+		if e.failures > failures {
+			failures = e.failures
+		}
+	}
+	count(&g.ips, LockKindIP, ip)
+	if knownUser {
+		count(&g.users, LockKindUser, name)
+	} else if attempt {
+		g.users.release(name, g.lockTime())
+	}
+	g.lock.Unlock()
+
+	for _, ev := range events {
+		g.lockouts.Add(1)
+		if nil != g.OnLockout {
+			g.OnLockout(ev.kind, ev.key, ev.failures)
+		}
+	}
+
+	return g.delay(failures), events
+}
+
+// Succeed 认证成功，清除来源IP和用户名的失败计数
+func (g *LoginGuard) Succeed(ip string, name string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.clear(&g.ips, ip, false)
+	g.clear(&g.users, name, false)
+}
+
+// clear 清除失败计数，仍有进行中的尝试时保留记录，调用方需持有lock
+func (g *LoginGuard) clear(table *guardTable, key string, attempt bool) {
+	e := table.lookup(key)
+	if nil == e {
+		return
+	}
+
+	if attempt && e.pending > 0 {
+		e.pending--
+	}
+	e.failures = 0
+	e.lastFail = time.Time{}
+	e.lockedUntil = time.Time{}
+	if e.pending <= 0 {
+		table.release(key, g.lockTime())
+	}
+}
+
+// loginAttempt 一次进行中的认证尝试，以 succeed、fail 或 cancel 结束
+type loginAttempt struct {
+	guard    *LoginGuard
+	ip, name string
+	counted  bool //已计入进行中的尝试，白名单IP不计入
+	done     bool
+}
+
+// begin 校验凭据前登记一次认证尝试：来源IP或用户名已锁定，或者进行中的尝试加上已失败次数达到上限时返回 ErrLoginLocked
+func (g *LoginGuard) begin(ip string, name string) (*loginAttempt, error) {
+	a := &loginAttempt{guard: g, ip: ip, name: name}
+	if g.IsWhitelisted(ip) {
+		return a, nil
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	entries := []*guardEntry{g.ips.get(ip, true, g.lockTime()), g.users.get(name, true, g.lockTime())}
+	for _, e := range entries {
+		if time.Now().Before(e.lockedUntil) || e.failures%g.maxFailures()+e.pending >= g.maxFailures() {
+			return nil, ErrLoginLocked
+		}
+	}
+	for _, e := range entries {
+		e.pending++
+	}
+	a.counted = true
+
+	return a, nil
+}
+
+// succeed 认证成功，清除失败计数
+func (a *loginAttempt) succeed() {
+	if nil == a || a.done {
+		return
+	}
+	a.done = true
+
+	a.guard.lock.Lock()
+	defer a.guard.lock.Unlock()
+
+	a.guard.clear(&a.guard.ips, a.ip, a.counted)
+	a.guard.clear(&a.guard.users, a.name, a.counted)
+}
+
+// fail 认证失败，返回回复前应等待的时间和触发的锁定；knownUser为false表示用户不存在
+func (a *loginAttempt) fail(knownUser bool) (time.Duration, []lockEvent) {
+	if nil == a || a.done {
+		return 0, nil
+	}
+	a.done = true
+
+	return a.guard.record(a.ip, a.name, a.counted, knownUser)
+}
+
+// cancel 尝试没有校验凭据就结束（如连接断开），不计入失败
+func (a *loginAttempt) cancel() {
+	if nil == a || a.done {
+		return
+	}
+	a.done = true
+	if !a.counted {
+		return
+	}
+
+	a.guard.lock.Lock()
+	defer a.guard.lock.Unlock()
+
+	a.guard.ips.release(a.ip, a.guard.lockTime())
+	a.guard.users.release(a.name, a.guard.lockTime())
+}
+
+func (g *LoginGuard) delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+
+	base := g.BaseDelay
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+	maxDelay := g.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 8 * time.Second
+	}
+
+	d := base
+	for i := 1; i < failures && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	return d
+}
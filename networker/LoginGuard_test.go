@@ -0,0 +1,123 @@
+package networker
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginGuardInflight(t *testing.T) {
+	g := &LoginGuard{MaxFailures: 3, BaseDelay: time.Millisecond}
+
+	//进行中的尝试达到上限后不再接受新的尝试
+	var attempts []*loginAttempt
+	for idx := 0; idx < 3; idx++ {
+		a, err := g.begin("10.0.0.1", "bob")
+		if nil != err {
+			t.Fatal("第", idx, "次尝试被拒绝", err)
+		}
+		attempts = append(attempts, a)
+	}
+	if _, err := g.begin("10.0.0.1", "bob"); err != ErrLoginLocked {
+		t.Fatal("超过上限的尝试没有被拒绝", err)
+	}
+
+	//取消的尝试不计入失败
+	attempts[0].cancel()
+	a, err := g.begin("10.0.0.1", "bob")
+	if nil != err {
+		t.Fatal("取消后仍被拒绝", err)
+	}
+	a.fail(true)
+	attempts[1].fail(true)
+	attempts[2].succeed()
+	if _, err = g.begin("10.0.0.1", "bob"); nil != err {
+		t.Fatal("认证成功后仍被拒绝", err)
+	}
+}
+
+func TestLoginGuardUnknownUser(t *testing.T) {
+	g := &LoginGuard{MaxFailures: 2, BaseDelay: time.Millisecond}
+
+	//不存在的用户名只按来源IP统计，不保留用户名记录
+	for idx := 0; idx < 2; idx++ {
+		a, err := g.begin("10.0.0.2", "nobody"+strconv.Itoa(idx))
+		if nil != err {
+			t.Fatal(err)
+		}
+		a.fail(false)
+	}
+	if len(g.users.entries) != 0 {
+		t.Fatal("保留了不存在的用户名", len(g.users.entries))
+	}
+	if g.CheckIP("10.0.0.2") != ErrLoginLocked {
+		t.Fatal("来源IP没有被锁定")
+	}
+	if _, err := g.begin("10.0.0.2", "other"); err != ErrLoginLocked {
+		t.Fatal("锁定的来源IP仍可尝试", err)
+	}
+}
+
+func TestLoginGuardEviction(t *testing.T) {
+	g := &LoginGuard{MaxFailures: 3, BaseDelay: time.Millisecond}
+
+	//锁定最早的用户，之后不断访问使其保持最近使用
+	for idx := 0; idx < 3; idx++ {
+		g.Fail("", "victim")
+	}
+	for idx := 0; idx < maxGuardEntries+100; idx++ {
+		g.Fail("10.1."+strconv.Itoa(idx/256)+"."+strconv.Itoa(idx%256), "user"+strconv.Itoa(idx))
+		if idx%1000 == 0 && g.CheckUser("", "victim") != ErrLoginLocked {
+			t.Fatal("最近使用的锁定记录被淘汰")
+		}
+	}
+
+	if len(g.users.entries) > maxGuardEntries || g.users.order.Len() != len(g.users.entries) {
+		t.Fatal("用户记录超过上限", len(g.users.entries), g.users.order.Len())
+	}
+	if len(g.ips.entries) > maxGuardEntries {
+		t.Fatal("IP记录超过上限", len(g.ips.entries))
+	}
+	if nil != g.users.lookup("user0") {
+		t.Fatal("最久未使用的记录没有被淘汰")
+	}
+	if nil == g.users.lookup("user"+strconv.Itoa(maxGuardEntries+99)) {
+		t.Fatal("最新的记录被淘汰")
+	}
+}
+
+func TestLoginGuardLockout(t *testing.T) {
+	events := make(chan string, 4)
+	guard := &LoginGuard{MaxFailures: 2, BaseDelay: time.Millisecond, LockTime: 300 * time.Millisecond}
+	guard.OnLockout = func(kind string, key string, failures int) {
+		events <- kind + ":" + key
+	}
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.Guard = guard
+	})
+
+	for idx := 0; idx < 2; idx++ {
+		cli := NewAesTcpClient()
+		if cli.Login("127.0.0.1", port, "admin", "bad", 3000) {
+			t.Fatal("错误口令登录成功")
+		}
+		<-ch
+	}
+	if guard.GetLockoutCount() != 2 || len(events) != 2 {
+		t.Fatal("没有锁定来源IP和用户名", guard.GetLockoutCount(), len(events))
+	}
+	if ev := <-events; ev != LockKindIP+":127.0.0.1" {
+		t.Fatal("锁定事件错误", ev)
+	}
+	if ev := <-events; ev != LockKindUser+":admin" {
+		t.Fatal("锁定事件错误", ev)
+	}
+
+	//锁定期间正确口令也不能登录，锁定过期后恢复
+	cli := NewAesTcpClient()
+	if cli.Login("127.0.0.1", port, "admin", "admin", 1000) {
+		t.Fatal("锁定期间登录成功")
+	}
+	time.Sleep(350 * time.Millisecond)
+	testLogin(t, cli, port)
+}
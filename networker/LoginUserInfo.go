@@ -1,7 +1,31 @@
 package networker
 
+// 登录使用的认证方式
+const (
+	authNamePassword = "password"
+)
+
 type LoginUserInfo struct {
-	ID       uint
-	Name     string
-	Password string
+	ID          uint
+	Name        string
+	Password    string
+	DisplayName string
+	Roles       []string
+	Claims      map[string]any //Authenticator提供的其他身份信息
+	AuthMethod  string         //认证方式：password、scram-sha-256、device-key、token
+	DeviceKey   string         //设备公钥认证时为设备公钥指纹
+}
+
+func (user *LoginUserInfo) HasRole(role string) bool {
+	if nil == user {
+		return false
+	}
+
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
 }
@@ -2,11 +2,26 @@ package networker
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 )
 
+const (
+	//数据长度最高位：数据后附加4字节CRC32C校验值（大端），校验范围为序号、数据长度、关联ID和数据
+	frameFlagCrc uint32 = 0x80000000
+	//数据长度次高位：扩展包头，数据长度后为4字节关联ID（大端），最高位表示回复包
+	frameFlagCorr uint32 = 0x40000000
+	frameFlags           = frameFlagCrc | frameFlagCorr
+
+	corrFlagReply uint32 = 0x80000000
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type Package struct {
-	PacSN uint16
-	Data  []byte
+	PacSN  uint16
+	CorrID uint32 //扩展包头中的关联ID，未协商时为0
+	Data   []byte
 }
 
 //export SetPacSN
@@ -20,12 +35,28 @@ func (pac *Package) GetPacSN() int {
 }
 
 func (pac *Package) ToPacStream() []byte {
-	return PacStream(pac.PacSN, pac.Data)
+	return pacStream(pac.PacSN, pac.CorrID, pac.Data, false)
 }
 
 func PacStream(sn uint16, data []byte) []byte {
-	dataLen := uint(len(data))
-	head := make([]byte, 8)
+	return pacStream(sn, 0, data, false)
+}
+
+// PacStreamCrc 打包并附加CRC32C校验值，接收方需支持校验功能
+func PacStreamCrc(sn uint16, data []byte) []byte {
+	return pacStream(sn, 0, data, true)
+}
+
+// pacStream 打包，corr不为0时使用扩展包头
+func pacStream(sn uint16, corr uint32, data []byte, withCrc bool) []byte {
+	dataLen := uint32(len(data))
+	if withCrc {
+		dataLen |= frameFlagCrc
+	}
+	if 0 != corr {
+		dataLen |= frameFlagCorr
+	}
+	head := make([]byte, 8, 12)
 
 	//包结构：包头2字节(0xAE86) + 序号2字节(小端结尾) + 命令2字节(小端结尾) + 数据长度4字节(小端结尾) + 数据不定长
 
@@ -37,8 +68,23 @@ func PacStream(sn uint16, data []byte) []byte {
 	head[5] = byte(dataLen >> 16)
 	head[6] = byte(dataLen >> 8)
 	head[7] = byte(dataLen)
+	if 0 != corr {
+		head = binary.BigEndian.AppendUint32(head, corr)
+	}
+
+	if !withCrc {
+		return bytes.Join([][]byte{head, data}, []byte(""))
+	}
+
+	sum := frameCrc(head[2:], data)
+	trailer := []byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)}
+
+	return bytes.Join([][]byte{head, data, trailer}, []byte(""))
+}
 
-	return bytes.Join([][]byte{head, data}, []byte(""))
+// frameCrc 包头（不含0xAE86）和数据的CRC32C校验值
+func frameCrc(head []byte, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(head, crcTable), crcTable, data)
 }
 
 func PacStreamJava(sn int, data []byte) []byte {
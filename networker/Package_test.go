@@ -0,0 +1,111 @@
+package networker
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCrcResync(t *testing.T) {
+	local, remote := net.Pipe()
+	//关闭对端后接收协程自行关闭连接
+	defer remote.Close()
+
+	tcp := NewClient(&local)
+	tcp.StartWaitLoop()
+
+	//CRC校验失败的帧
+	bad := PacStreamCrc(2, []byte("corrupt"))
+	bad[10] ^= 0xFF
+	//长度被破坏的帧
+	badLen := PacStreamCrc(4, []byte("x"))
+	badLen[4] = 0xFF
+
+	stream := bytes.Join([][]byte{
+		PacStreamCrc(1, []byte("one")),
+		bad,
+		badLen,
+		PacStreamCrc(3, []byte("three")),
+		PacStream(5, []byte("plain")),
+	}, nil)
+	go remote.Write(stream)
+
+	for _, want := range []string{"one", "three", "plain"} {
+		pac := tcp.readPackage(2000)
+		if nil == pac {
+			t.Fatal("没有收到", want)
+		}
+		if string(pac.Data) != want {
+			t.Fatal("收到", string(pac.Data), "期望", want)
+		}
+	}
+
+	if tcp.GetCrcErrorCount() != 2 {
+		t.Fatal("CRC错误计数", tcp.GetCrcErrorCount())
+	}
+}
+
+func TestPacSNExhausted(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+
+	tcp := NewClient(&local)
+	defer tcp.Close()
+
+	//除5以外的序号都在等待回复，使用关联ID的等待不占用序号
+	ch := make(chan bool, 1)
+	for sn := uint16(0); sn <= maxPacSN; sn++ {
+		if 5 != sn {
+			tcp.addWait(waitKey{sn: 0x8000 | sn}, &ch)
+		}
+		tcp.addWait(waitKey{sn: 0x8000 | sn, corr: corrFlagReply | 1}, &ch)
+	}
+	if sn, err := tcp.GetNexPacSNErr(); nil != err || 5 != sn {
+		t.Fatal("没有跳到空闲序号", sn, err)
+	}
+
+	tcp.addWait(waitKey{sn: 0x8000 | 5}, &ch)
+	if _, err := tcp.GetNexPacSNErr(); err != ErrPacSNExhausted {
+		t.Fatal("序号用尽时应返回 ErrPacSNExhausted", err)
+	}
+
+	tcp.waitLock.Lock()
+	tcp.removeWait(waitKey{sn: 0x8000 | 100})
+	tcp.waitLock.Unlock()
+	if sn, err := tcp.GetNexPacSNErr(); nil != err || 100 != sn {
+		t.Fatal("没有使用释放的序号", sn, err)
+	}
+
+	//等待超时后释放序号
+	tcp.waitLock.Lock()
+	tcp.removeWait(waitKey{sn: 0x8000 | 200})
+	tcp.waitLock.Unlock()
+	if _, err := tcp.SendAndWaitErr(200, []byte("x"), 10); err != ErrReplyTimeout {
+		t.Fatal("应返回 ErrReplyTimeout", err)
+	}
+	if sn, err := tcp.GetNexPacSNErr(); nil != err || 200 != sn {
+		t.Fatal("超时的等待没有释放序号", sn, err)
+	}
+}
+
+func TestRecordCorrLimit(t *testing.T) {
+	tcp := &PackagedTcpClient{}
+
+	//同一序号未回复的请求超过上限时不再记录，按顺序回复时前面的请求仍取得正确的关联ID
+	for corr := uint32(1); corr <= 100; corr++ {
+		tcp.recordCorr(7, corr)
+	}
+	if len(tcp.inCorr[7]) != 64 {
+		t.Fatal("同一序号的记录没有限制", len(tcp.inCorr[7]))
+	}
+	for corr := uint32(1); corr <= 64; corr++ {
+		if got := tcp.replyCorr(0x8000|7, 0); got != corr|corrFlagReply {
+			t.Fatal("回复的关联ID错误", corr, got)
+		}
+	}
+	if got := tcp.replyCorr(0x8000|7, 0); 0 != got {
+		t.Fatal("超出上限的请求不应有关联ID", got)
+	}
+}
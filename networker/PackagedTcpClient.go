@@ -27,16 +27,41 @@ SOFTWARE.
 package networker
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrPacSNInUse 序号正在等待回复，SendAndWait 拒绝发送而不是覆盖等待
+var ErrPacSNInUse = errors.New("packet sn is still waiting for a reply")
+
+// ErrReplyTimeout 等待回复超时
+var ErrReplyTimeout = errors.New("timed out waiting for a reply")
+
+// ErrPacSNExhausted 所有序号都在等待回复，没有可用的序号
+var ErrPacSNExhausted = errors.New("all packet sns are waiting for a reply")
+
+const maxPacSN = 32760 //请求包序号范围0~maxPacSN
+
+// waitKey 等待回复的标识：回复包序号和关联ID（未协商关联ID时为0）
+type waitKey struct {
+	sn   uint16
+	corr uint32
+}
+
+const (
+	DefaultMaxFrameSize        uint32 = 64 << 20 //认证后接收数据帧的默认最大长度
+	DefaultMaxPreAuthFrameSize uint32 = 64 << 10 //认证完成前接收数据帧的默认最大长度
+)
+
 type PackagedTcpClient struct {
 	tcpClientBase
 
@@ -50,23 +75,102 @@ type PackagedTcpClient struct {
 
 	ansLock  sync.Mutex
 	waitLock sync.Mutex
-	waitChan map[uint16]*chan bool
-	answer   map[uint16]*Package
+	waitChan map[waitKey]*chan bool
+	snWaits  int //waitChan中未使用关联ID的等待数量，受waitLock保护
+	answer   map[waitKey]*Package
+	inCorr   map[uint16][]uint32 //收到的请求的关联ID，回复时按序号取出，受waitLock保护
+	curCorr  atomic.Uint32
 
 	readPacChan  chan bool
 	OnOnePackage func(tcp *PackagedTcpClient, pacSN uint16, data []byte)
+	onPackage    atomic.Pointer[func(pac *Package)] //内部使用的回调，需要包的关联ID；设置后代替 OnOnePackage，连接收包时可能被替换
+
+	MaxFrameSize uint32        //接收数据帧的最大长度，超过时断开连接；为0时使用 DefaultMaxFrameSize
+	frameLimit   atomic.Uint32 //认证完成前的临时限制，为0时使用MaxFrameSize
+
+	crc       atomic.Bool   //发送的数据帧附加CRC32C校验值
+	corrIDs   atomic.Bool   //SendAndWait 使用扩展包头中的32位关联ID匹配回复
+	snInUse   atomic.Uint64 //因序号正在等待回复被拒绝的 SendAndWait 次数
+	crcErrors atomic.Uint64 //CRC校验失败被丢弃的数据帧数
+	resync    []byte        //CRC校验失败后需要重新查找包头的数据，只在接收协程中使用
 }
 
+// GetNexPacSN 下一个请求包序号，跳过正在等待回复的序号；序号用尽时仍返回下一个序号，SendAndWait 会返回 ErrPacSNInUse
 func (tcp *PackagedTcpClient) GetNexPacSN() uint16 {
+	pacSN, _ := tcp.GetNexPacSNErr()
+	return pacSN
+}
+
+// GetNexPacSNErr 同 GetNexPacSN，所有序号都在等待回复时返回 ErrPacSNExhausted
+func (tcp *PackagedTcpClient) GetNexPacSNErr() (uint16, error) {
 	tcp.lckSN.Lock()
 	defer tcp.lckSN.Unlock()
 
+	tcp.waitLock.Lock()
+	defer tcp.waitLock.Unlock()
+
 	tcp.curPacSN++
-	if tcp.curPacSN > 32760 {
+	if tcp.curPacSN > maxPacSN {
 		tcp.curPacSN = 0
 	}
+	if tcp.snWaits > maxPacSN {
+		return tcp.curPacSN, ErrPacSNExhausted
+	}
+
+	//跳过正在等待回复的序号，还有空闲序号时最多跳过snWaits个
+	for tcp.isWaiting(tcp.curPacSN) {
+		tcp.curPacSN++
+		if tcp.curPacSN > maxPacSN {
+			tcp.curPacSN = 0
+		}
+	}
+
+	return tcp.curPacSN, nil
+}
+
+// isWaiting 序号是否有未使用关联ID的等待，调用方需持有waitLock
+func (tcp *PackagedTcpClient) isWaiting(pacSN uint16) bool {
+	_, has := tcp.waitChan[waitKey{sn: 0x8000 | pacSN}]
+	return has
+}
+
+// addWait 登记等待回复，序号正在等待时返回false，调用方需持有waitLock
+func (tcp *PackagedTcpClient) addWait(key waitKey, ch *chan bool) bool {
+	if nil == tcp.waitChan {
+		tcp.waitChan = make(map[waitKey]*chan bool)
+	}
+	if _, busy := tcp.waitChan[key]; busy {
+		return false
+	}
 
-	return tcp.curPacSN
+	tcp.waitChan[key] = ch
+	if 0 == key.corr {
+		tcp.snWaits++
+	}
+
+	return true
+}
+
+// removeWait 结束等待回复，调用方需持有waitLock
+func (tcp *PackagedTcpClient) removeWait(key waitKey) {
+	if _, has := tcp.waitChan[key]; !has {
+		return
+	}
+
+	delete(tcp.waitChan, key)
+	if 0 == key.corr {
+		tcp.snWaits--
+	}
+}
+
+// nextCorrID 下一个关联ID，范围1~0x7FFFFFFF
+func (tcp *PackagedTcpClient) nextCorrID() uint32 {
+	for {
+		corr := tcp.curCorr.Add(1) &^ corrFlagReply
+		if 0 != corr {
+			return corr
+		}
+	}
 }
 
 func (tcp *PackagedTcpClient) GetNexPacSNJava() int {
@@ -75,10 +179,10 @@ func (tcp *PackagedTcpClient) GetNexPacSNJava() int {
 
 func NewClient(conn *net.Conn) *PackagedTcpClient {
 	tcp := PackagedTcpClient{}
-	tcp.conn = conn
+	tcp.conn.Store(conn)
 	tcp.pacQueue = list.New()
-	tcp.answer = make(map[uint16]*Package)
-	tcp.waitChan = make(map[uint16]*chan bool)
+	tcp.answer = make(map[waitKey]*Package)
+	tcp.waitChan = make(map[waitKey]*chan bool)
 
 	// tcp.reader = bufio.NewReader(*conn)
 	tcp.readPacChan = make(chan bool, 10)
@@ -95,13 +199,13 @@ func (tcp *PackagedTcpClient) Connect(svr string, port int, msWait int) bool {
 
 	tcp.ansLock.Lock()
 	if nil == tcp.answer {
-		tcp.answer = make(map[uint16]*Package)
+		tcp.answer = make(map[waitKey]*Package)
 	}
 	tcp.ansLock.Unlock()
 
 	tcp.waitLock.Lock()
 	if nil == tcp.waitChan {
-		tcp.waitChan = make(map[uint16]*chan bool)
+		tcp.waitChan = make(map[waitKey]*chan bool)
 		tcp.readPacChan = make(chan bool, 10)
 	}
 	tcp.waitLock.Unlock()
@@ -109,6 +213,18 @@ func (tcp *PackagedTcpClient) Connect(svr string, port int, msWait int) bool {
 	return tcp.tcpClientBase.Connect(svr, port, msWait)
 }
 
+// maxFrameSize 当前接收数据帧的最大长度
+func (tcp *PackagedTcpClient) maxFrameSize() uint32 {
+	if limit := tcp.frameLimit.Load(); limit > 0 {
+		return limit
+	}
+	if tcp.MaxFrameSize > 0 {
+		return tcp.MaxFrameSize
+	}
+
+	return DefaultMaxFrameSize
+}
+
 func (tcp *PackagedTcpClient) StartWaitLoop() {
 	go tcp.waitLoop()
 }
@@ -117,8 +233,109 @@ func (tcp *PackagedTcpClient) SendJava(pacSN int, data []byte) bool {
 	return tcp.Send(uint16(pacSN), data)
 }
 
+// SetCrc 设置发送的数据帧是否附加CRC32C校验值，需对端支持；AesTcpClient 在握手时协商，不需要调用
+func (tcp *PackagedTcpClient) SetCrc(enable bool) {
+	tcp.crc.Store(enable)
+}
+
+// SetCorrID 设置 SendAndWait 是否使用32位关联ID，需对端支持；AesTcpClient 在握手时协商，不需要调用
+func (tcp *PackagedTcpClient) SetCorrID(enable bool) {
+	tcp.corrIDs.Store(enable)
+}
+
+// GetSNInUseCount 因序号正在等待回复被拒绝的 SendAndWait 次数
+func (tcp *PackagedTcpClient) GetSNInUseCount() uint64 {
+	return tcp.snInUse.Load()
+}
+
+// GetCrcErrorCount CRC校验失败被丢弃的数据帧数
+func (tcp *PackagedTcpClient) GetCrcErrorCount() uint64 {
+	return tcp.crcErrors.Load()
+}
+
+// readStream 接收协程读取数据，先使用重新同步缓存中的数据
+func (tcp *PackagedTcpClient) readStream(dataLen uint32, buf []byte, msWait int) error {
+	n := uint32(copy(buf[:dataLen], tcp.resync))
+	tcp.resync = tcp.resync[n:]
+	if n >= dataLen {
+		return nil
+	}
+
+	return tcp.ReadDataWithTimeOut(dataLen-n, buf[n:], msWait)
+}
+
 func (tcp *PackagedTcpClient) Send(pacSN uint16, data []byte) bool {
-	stream := PacStream(pacSN, data)
+	var corr uint32
+	if 0 != pacSN&0x8000 {
+		corr = tcp.replyCorr(pacSN, 0)
+	}
+
+	return tcp.send(pacSN, corr, data)
+}
+
+// SendReply 回复收到的请求，协商了关联ID时带回请求的关联ID，回复顺序不受限制
+func (tcp *PackagedTcpClient) SendReply(req *Package, data []byte) bool {
+	ansSN := 0x8000 | req.PacSN
+
+	return tcp.send(ansSN, tcp.replyCorr(ansSN, req.CorrID), data)
+}
+
+// replyCorr 取出回复对应请求的关联ID；corr为0时同一序号的多个请求按收到的顺序取出，
+// 乱序回复时应使用 SendReply 指定请求
+func (tcp *PackagedTcpClient) replyCorr(ansSN uint16, corr uint32) uint32 {
+	tcp.waitLock.Lock()
+	defer tcp.waitLock.Unlock()
+
+	sn := ansSN & 0x7FFF
+	ids := tcp.inCorr[sn]
+	if len(ids) <= 0 {
+		return 0
+	}
+
+	idx := 0
+	if 0 != corr {
+		idx = -1
+		for i, id := range ids {
+			if id == corr {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			return 0
+		}
+	}
+	corr = ids[idx]
+
+	if len(ids) == 1 {
+		delete(tcp.inCorr, sn)
+	} else {
+		tcp.inCorr[sn] = append(ids[:idx:idx], ids[idx+1:]...)
+	}
+
+	return corr | corrFlagReply
+}
+
+// recordCorr 记录收到的请求的关联ID，对端未回复的记录过多时清除；
+// 同一序号未回复的请求过多时不再记录，按顺序回复时超出的请求的回复不带关联ID
+func (tcp *PackagedTcpClient) recordCorr(pacSN uint16, corr uint32) {
+	const maxEntries = 4096
+	const maxPerSN = 64
+
+	tcp.waitLock.Lock()
+	defer tcp.waitLock.Unlock()
+
+	if nil == tcp.inCorr || len(tcp.inCorr) >= maxEntries {
+		tcp.inCorr = make(map[uint16][]uint32)
+	}
+	if len(tcp.inCorr[pacSN]) >= maxPerSN {
+		return
+	}
+	tcp.inCorr[pacSN] = append(tcp.inCorr[pacSN], corr)
+}
+
+func (tcp *PackagedTcpClient) send(pacSN uint16, corr uint32, data []byte) bool {
+	stream := pacStream(pacSN, corr, data, tcp.crc.Load())
 
 	// fmt.Println(tcp.ClientFlag, "发送数据:", hex.EncodeToString(stream))
 
@@ -131,66 +348,67 @@ func (tcp *PackagedTcpClient) SendAndWaitJava(pacSN int, data []byte, msWait int
 	return tcp.SendAndWait(uint16(pacSN), data, msWait)
 }
 
+// SendAndWait 发送并等待回复；序号仍在等待上一个回复时返回nil，不覆盖正在进行的等待
+// 协商了关联ID时按关联ID匹配回复，序号重复不影响匹配
 func (tcp *PackagedTcpClient) SendAndWait(pacSN uint16, data []byte, msWait int) *Package {
-	has := false
-	ch := make(chan bool)
-	ansSN := uint16(0x8000 | pacSN)
-	//清理旧的回应包
-	tcp.ansLock.Lock()
-	if nil == tcp.answer {
-		tcp.answer = make(map[uint16]*Package)
-	} else {
-		_, has = tcp.answer[pacSN]
-		if has {
-			delete(tcp.answer, pacSN)
-		}
-		_, has = tcp.answer[ansSN]
-		if has {
-			delete(tcp.answer, ansSN)
-		}
+	pac, _ := tcp.SendAndWaitErr(pacSN, data, msWait)
+	return pac
+}
+
+// SendAndWaitErr 同 SendAndWait，没有回复时返回原因：ErrPacSNInUse、ErrReplyTimeout 或连接已关闭
+func (tcp *PackagedTcpClient) SendAndWaitErr(pacSN uint16, data []byte, msWait int) (*Package, error) {
+	key := waitKey{sn: 0x8000 | pacSN}
+	var corr uint32
+	if tcp.corrIDs.Load() {
+		corr = tcp.nextCorrID()
+		key.corr = corr | corrFlagReply
 	}
-	tcp.ansLock.Unlock()
+	ch := make(chan bool, 1)
 
-	//清理旧的等待信号
+	//添加新的等待信号
 	tcp.waitLock.Lock()
-	if nil == tcp.waitChan {
-		tcp.waitChan = map[uint16]*chan bool{}
-	} else {
-		_, has = tcp.waitChan[pacSN]
-		if has {
-			delete(tcp.waitChan, pacSN)
-		}
-		_, has = tcp.waitChan[ansSN]
-		if has {
-			delete(tcp.waitChan, ansSN)
-		}
+	if !tcp.addWait(key, &ch) {
+		tcp.waitLock.Unlock()
+		tcp.snInUse.Add(1)
+		fmt.Println(tcp.ClientFlag, "PackagedTcpClient.SendAndWait PacSN=", pacSN, ErrPacSNInUse)
+		return nil, ErrPacSNInUse
 	}
-	//添加新的等待信号
-	tcp.waitChan[ansSN] = &ch
 	tcp.waitLock.Unlock()
 
-	//发送指令数据
-	tcp.Send(pacSN, data)
+	//清理旧的回应包
+	tcp.ansLock.Lock()
+	if nil == tcp.answer {
+		tcp.answer = make(map[waitKey]*Package)
+	}
+	delete(tcp.answer, key)
+	tcp.ansLock.Unlock()
 
 	var pac *Package
+	var err error
 
-	//等待结果
-	select {
-	case <-ch:
-		pac, has = tcp.answer[ansSN]
-		if !has {
-			pac = nil
-		} else {
-			delete(tcp.answer, ansSN)
+	//发送指令数据，发送失败时不再等待
+	if !tcp.send(pacSN, corr, data) {
+		err = net.ErrClosed
+	} else {
+		//等待结果
+		select {
+		case <-ch:
+			tcp.ansLock.Lock()
+			pac = tcp.answer[key]
+			delete(tcp.answer, key)
+			tcp.ansLock.Unlock()
+		case <-time.After(time.Duration(int64(msWait) * int64(time.Millisecond))):
+			err = ErrReplyTimeout
 		}
-	case <-time.After(time.Duration(int64(msWait) * int64(time.Millisecond))):
-		pac = nil
-		has = false
 	}
 
-	delete(tcp.waitChan, ansSN)
+	tcp.waitLock.Lock()
+	if tcp.waitChan[key] == &ch {
+		tcp.removeWait(key)
+	}
+	tcp.waitLock.Unlock()
 
-	return pac
+	return pac, err
 }
 
 func (tcp *PackagedTcpClient) waitLoop() {
@@ -204,7 +422,7 @@ func (tcp *PackagedTcpClient) waitLoop() {
 		// fmt.Println("PackagedTcpClient.waitLoop End")
 	}()
 
-	if nil == tcp.conn /*|| nil == tcp.reader*/ {
+	if nil == tcp.conn.Load() /*|| nil == tcp.reader*/ {
 		return
 	}
 
@@ -212,21 +430,21 @@ func (tcp *PackagedTcpClient) waitLoop() {
 	var dataLen uint32
 	var data []byte
 	var err error
-	buf := make([]byte, 8)
+	buf := make([]byte, 14) //序号2字节 + 数据长度4字节 + 关联ID 4字节 + CRC 4字节
 
-	for nil != tcp.conn {
+	for nil != tcp.conn.Load() {
 		// fmt.Println("PackagedTcpClient.waitLoop 循环开始")
 		//读0xAE
-		for nil != tcp.conn {
+		for nil != tcp.conn.Load() {
 			buf[0] = 0
 			// fmt.Println("PackagedTcpClient.waitLoop 读0xAE Begin buf[0]=", buf[0])
-			err = tcp.ReadDataWithTimeOut(1, buf, 60*60*1000) //1小时等待新数据
+			err = tcp.readStream(1, buf, 60*60*1000) //1小时等待新数据
 			// fmt.Println("PackagedTcpClient.waitLoop 读0xAE End buf[0]=", buf[0])
 			if nil != err {
 
 				//如果没有接收到任何数据会产生超时错误，忽略此错误，继续等待数据
-				operr := err.(*net.OpError)
-				if nil != operr && operr.Timeout() {
+				operr, isOpErr := err.(*net.OpError)
+				if isOpErr && operr.Timeout() {
 					continue
 				} else if strings.Contains(err.Error(), "timeout") {
 					// fmt.Println("PackagedTcpClient.waitLoop 读0xAE timeout", err)
@@ -253,7 +471,7 @@ func (tcp *PackagedTcpClient) waitLoop() {
 		//读0x86
 		for {
 			// fmt.Println("PackagedTcpClient.waitLoop 读0x86")
-			err = tcp.ReadData(1, buf)
+			err = tcp.readStream(1, buf, 1000)
 			if nil != err {
 				fmt.Println("PackagedTcpClient.waitLoop 读86异常", err)
 
@@ -268,6 +486,7 @@ func (tcp *PackagedTcpClient) waitLoop() {
 			} else if buf[0] == 0xAE {
 				continue
 			}
+			break
 		}
 		if buf[0] != 0x86 {
 			fmt.Println("非包头数据0x86", buf[0])
@@ -275,7 +494,7 @@ func (tcp *PackagedTcpClient) waitLoop() {
 		}
 
 		//读PacSN
-		err = tcp.ReadData(2, buf)
+		err = tcp.readStream(2, buf, 1000)
 		if nil != err {
 			fmt.Println("PackagedTcpClient.waitLoop 读PacSN异常", err)
 
@@ -290,7 +509,7 @@ func (tcp *PackagedTcpClient) waitLoop() {
 		pacSN |= uint16(buf[1])
 
 		//读dataLen
-		err = tcp.ReadData(4, buf)
+		err = tcp.readStream(4, buf[2:], 1000)
 		if nil != err {
 			fmt.Println("PackagedTcpClient.waitLoop 读dataLen异常", err)
 
@@ -301,14 +520,50 @@ func (tcp *PackagedTcpClient) waitLoop() {
 			}
 			continue
 		}
-		dataLen = uint32(buf[0]) << 24
-		dataLen |= uint32(buf[1]) << 16
-		dataLen |= uint32(buf[2]) << 8
-		dataLen |= uint32(buf[3])
+		dataLen = uint32(buf[2]) << 24
+		dataLen |= uint32(buf[3]) << 16
+		dataLen |= uint32(buf[4]) << 8
+		dataLen |= uint32(buf[5])
+		hasCrc := 0 != dataLen&frameFlagCrc
+		headLen := 6
+		if 0 != dataLen&frameFlagCorr {
+			headLen = 10
+		}
+		dataLen &^= frameFlags
+
+		//长度超过限制时不分配缓冲区，直接断开连接；带CRC的数据帧视为长度字段损坏，重新查找包头
+		if limit := tcp.maxFrameSize(); dataLen > limit && hasCrc {
+			tcp.crcErrors.Add(1)
+			fmt.Println(tcp.ClientFlag, "PackagedTcpClient.waitLoop 数据帧长度", dataLen, "超过限制", limit, "重新查找包头")
+			tcp.resync = bytes.Join([][]byte{{0x86}, buf[:6], tcp.resync}, nil)
+			continue
+		} else if dataLen > limit {
+			fmt.Println(tcp.ClientFlag, "PackagedTcpClient.waitLoop 数据帧长度", dataLen, "超过限制", limit, "断开连接", tcp.remoteAddr)
+			tcp.Close()
+			tcp.readPacChan <- true
+			return
+		}
+
+		//读关联ID
+		var corr uint32
+		if headLen > 6 {
+			err = tcp.readStream(4, buf[6:], 1000)
+			if nil != err {
+				fmt.Println("PackagedTcpClient.waitLoop 读关联ID异常", err)
+
+				if errors.Is(err, io.EOF) || strings.Contains(err.Error(), "closed") {
+					tcp.Close()
+					tcp.readPacChan <- true
+					return
+				}
+				continue
+			}
+			corr = binary.BigEndian.Uint32(buf[6:])
+		}
 
 		//读data
 		data = make([]byte, dataLen)
-		err = tcp.ReadData(dataLen, data)
+		err = tcp.readStream(dataLen, data, 1000)
 		if nil != err {
 			fmt.Println("PackagedTcpClient.waitLoop 读dataLen异常", err)
 
@@ -320,30 +575,57 @@ func (tcp *PackagedTcpClient) waitLoop() {
 			continue
 		}
 
-		pac := Package{PacSN: pacSN, Data: data}
+		//校验CRC32C，校验失败时丢弃数据帧，从包头0xAE之后的数据重新查找包头
+		if hasCrc {
+			err = tcp.readStream(4, buf[headLen:], 1000)
+			if nil != err {
+				fmt.Println("PackagedTcpClient.waitLoop 读CRC异常", err)
+
+				if errors.Is(err, io.EOF) || strings.Contains(err.Error(), "closed") {
+					tcp.Close()
+					tcp.readPacChan <- true
+					return
+				}
+				continue
+			}
+
+			if binary.BigEndian.Uint32(buf[headLen:]) != frameCrc(buf[:headLen], data) {
+				tcp.crcErrors.Add(1)
+				fmt.Println(tcp.ClientFlag, "PackagedTcpClient.waitLoop CRC校验失败，丢弃数据帧 PacSN=", pacSN)
+				tcp.resync = bytes.Join([][]byte{{0x86}, buf[:headLen], data, buf[headLen : headLen+4], tcp.resync}, nil)
+				continue
+			}
+		}
+
+		pac := Package{PacSN: pacSN, CorrID: corr, Data: data}
 		// fmt.Println(tcp.ClientFlag, "收到数据 SN=", pacSN, " Data=", hex.EncodeToString(data))
 
 		//回复包保存到结果字典中
 		isWaitPac := false
 		var ch *chan bool
 		if (0x8000 & pacSN) > 0 {
+			key := waitKey{sn: pacSN, corr: corr}
 			tcp.waitLock.Lock()
-			ch, isWaitPac = tcp.waitChan[pacSN]
+			ch, isWaitPac = tcp.waitChan[key]
 			if isWaitPac {
-				delete(tcp.waitChan, pacSN)
+				tcp.removeWait(key)
 			}
 			tcp.waitLock.Unlock()
 
 			if isWaitPac {
 				// fmt.Println("收到回复包保存到结果字典 PacSN=", pacSN&0x7FFF)
 				tcp.ansLock.Lock()
-				tcp.answer[pacSN] = &pac
+				tcp.answer[key] = &pac
 				tcp.ansLock.Unlock()
 
 				(*ch) <- true
 			}
 		}
 
+		if 0 == (0x8000&pacSN) && 0 != corr {
+			tcp.recordCorr(pacSN, corr)
+		}
+
 		if !isWaitPac {
 			//非回复包放入队列
 			// pacCount := 0
@@ -358,7 +640,7 @@ func (tcp *PackagedTcpClient) waitLoop() {
 			tcp.queLock.Unlock()
 
 			//有回调函数则通过回调函数通知调用方；否则通过信号通知取包线程
-			if nil == tcp.OnOnePackage {
+			if nil == tcp.OnOnePackage && nil == tcp.onPackage.Load() {
 				//发送信号唤醒取包线程
 				// fmt.Println("没有回调函数")
 				// if pacCount == 1 {
@@ -380,25 +662,33 @@ func (tcp *PackagedTcpClient) invokePackageWorker() {
 	}
 
 	for {
-		if tcp.pacQueue.Len() <= 0 {
-			break
-		}
-
 		tcp.queLock.Lock()
 		el := tcp.pacQueue.Front()
-		tcp.pacQueue.Remove(el)
+		if nil != el {
+			tcp.pacQueue.Remove(el)
+		}
 		tcp.queLock.Unlock()
 
+		if nil == el {
+			break
+		}
+
 		pac := el.Value.(*Package)
 
-		if nil != tcp.OnOnePackage {
+		if handler := tcp.onPackage.Load(); nil != handler {
+			(*handler)(pac)
+		} else if nil != tcp.OnOnePackage {
 			tcp.OnOnePackage(tcp, pac.PacSN, pac.Data)
 		}
 	}
 
 	tcp.workerLock.Unlock()
 
-	if tcp.pacQueue.Len() > 0 {
+	tcp.queLock.Lock()
+	pending := tcp.pacQueue.Len() > 0
+	tcp.queLock.Unlock()
+
+	if pending {
 		go tcp.invokePackageWorker()
 	}
 }
@@ -408,30 +698,31 @@ func (tcp *PackagedTcpClient) ReadPackage() *Package {
 }
 
 func (tcp *PackagedTcpClient) readPackage(msTimeOut int) *Package {
-	if tcp.pacQueue.Len() <= 0 {
-		if msTimeOut <= 0 {
-			<-tcp.readPacChan
-		} else {
-			//等待结果
-			select {
-			case <-tcp.readPacChan:
-			case <-time.After(time.Duration(int64(msTimeOut) * int64(time.Millisecond))):
-				return nil
-			}
-		}
+	var timeOut <-chan time.Time
+	if msTimeOut > 0 {
+		timeOut = time.After(time.Duration(int64(msTimeOut) * int64(time.Millisecond)))
 	}
 
-	tcp.queLock.Lock()
-	defer tcp.queLock.Unlock()
+	for {
+		tcp.queLock.Lock()
+		if tcp.pacQueue.Len() > 0 {
+			el := tcp.pacQueue.Front()
+			tcp.pacQueue.Remove(el)
+			tcp.queLock.Unlock()
 
-	if tcp.pacQueue.Len() > 0 {
+			return el.Value.(*Package)
+		}
+		tcp.queLock.Unlock()
 
-		el := tcp.pacQueue.Front()
-		tcp.pacQueue.Remove(el)
-		pac := el.Value.(*Package)
+		if nil == tcp.conn.Load() {
+			return nil
+		}
 
-		return pac
+		//等待结果；信号可能是之前已取走的包留下的，队列为空时继续等待
+		select {
+		case <-tcp.readPacChan:
+		case <-timeOut:
+			return nil
+		}
 	}
-
-	return nil
 }
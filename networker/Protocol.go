@@ -0,0 +1,114 @@
+package networker
+
+// 协议版本和功能协商：服务端在握手首条消息的Ext中发送协议版本和支持的功能位图，
+// 客户端回复双方都支持的版本（取较小值）和功能（取交集），结果保存在会话中，
+// 后续处理按会话的功能位图选择编码方式。旧版对端不发送版本，按版本1处理，不启用任何功能
+// TLS连接没有密钥交换，在第一次请求用户名口令时协商
+
+const (
+	ProtocolVersion       uint16 = 2 //当前协议版本
+	protocolVersionLegacy uint16 = 1 //不支持版本协商的旧版协议
+)
+
+// Capability 功能位图
+type Capability uint32
+
+const (
+	Cap_Aead      Capability = 1 << iota //AEAD加密套件（GCM、ChaCha20-Poly1305）
+	Cap_Compress                         //数据压缩
+	Cap_LargeJson                        //JSON段超过64KB
+	Cap_Crc32c                           //数据帧附加CRC32C校验值
+	Cap_CorrID                           //扩展包头中的32位关联ID
+	Cap_Stream                           //分块发送的数据流
+)
+
+func (caps Capability) Has(c Capability) bool {
+	return caps&c == c
+}
+
+// localCaps 本端支持的功能
+func (tcp *AesTcpClient) localCaps() Capability {
+	caps := Cap_LargeJson | Cap_CorrID | Cap_Stream
+
+	for _, name := range tcp.cipherSuiteList() {
+		if suite, known := cipherSuites[name]; known && suite.mode != Cipher_AesCbc {
+			caps |= Cap_Aead
+			break
+		}
+	}
+	if tcp.EnableCrc {
+		caps |= Cap_Crc32c
+	}
+	if tcp.EnableCompress {
+		caps |= Cap_Compress
+	}
+
+	return caps
+}
+
+// offerProtocol 服务端在首条握手消息中提供协议版本和功能
+func (ptc *AesTcpClient) offerProtocol(ext *HandshakeExt) {
+	ext.Ver = ProtocolVersion
+	ext.Caps = ptc.localCaps()
+}
+
+// agreeProtocol 客户端按服务端提供的版本和功能确定双方使用的版本和功能，写入回复
+func (tcp *AesTcpClient) agreeProtocol(codec *frameCodec, offer *HandshakeExt, choice *HandshakeExt) {
+	codec.ver = protocolVersionLegacy
+	codec.caps = 0
+	if nil == offer || offer.Ver <= protocolVersionLegacy {
+		return
+	}
+
+	codec.ver = offer.Ver
+	if codec.ver > ProtocolVersion {
+		codec.ver = ProtocolVersion
+	}
+	codec.caps = offer.Caps & tcp.localCaps()
+	tcp.applyFrameCaps(codec.caps)
+	if nil != choice {
+		choice.Ver = codec.ver
+		choice.Caps = codec.caps
+	}
+}
+
+// applyProtocol 服务端按客户端的回复设置版本和功能，客户端不能启用服务端未提供的功能
+func (ptc *AesTcpClient) applyProtocol(choice *HandshakeExt) {
+	ptc.codec.ver = protocolVersionLegacy
+	ptc.codec.caps = 0
+	if nil == choice || choice.Ver <= protocolVersionLegacy {
+		return
+	}
+
+	ptc.codec.ver = choice.Ver
+	if ptc.codec.ver > ProtocolVersion {
+		ptc.codec.ver = ProtocolVersion
+	}
+	ptc.codec.caps = choice.Caps & ptc.localCaps()
+	ptc.applyFrameCaps(ptc.codec.caps)
+}
+
+// applyFrameCaps 设置由 PackagedTcpClient 处理的功能，接收时按包头标志识别，发送方可以先于对端启用
+func (tcp *AesTcpClient) applyFrameCaps(caps Capability) {
+	tcp.SetCrc(caps.Has(Cap_Crc32c))
+	tcp.SetCorrID(caps.Has(Cap_CorrID))
+}
+
+// GetProtocolVersion 会话使用的协议版本
+func (tcp *AesTcpClient) GetProtocolVersion() uint16 {
+	if tcp.codec.ver <= 0 {
+		return protocolVersionLegacy
+	}
+
+	return tcp.codec.ver
+}
+
+// GetCapabilities 会话启用的功能
+func (tcp *AesTcpClient) GetCapabilities() Capability {
+	return tcp.codec.caps
+}
+
+// HasCapability 会话是否启用了功能
+func (tcp *AesTcpClient) HasCapability(c Capability) bool {
+	return tcp.codec.caps.Has(c)
+}
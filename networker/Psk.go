@@ -0,0 +1,137 @@
+package networker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// 预共享密钥握手：代替 Cmd_GetAesKey 流程，不需要生成ECC密钥，适合计算能力有限的设备
+//  1. 服务端发送 Cmd_PskHello（明文），Data为服务端随机数，Ext为提供的扩展功能
+//  2. 客户端回复密钥ID、客户端随机数和密钥确认码，Ext为选择的扩展功能
+//  3. 服务端按密钥ID查找密钥并校验确认码，双方以握手记录为盐经HKDF派生两个方向的会话密钥
+// 客户端没有配置密钥时拒绝PSK握手，服务端改用ECC密钥交换，TcpListener.RequirePsk 时断开连接
+// 握手记录包含双方的完整消息，篡改扩展功能选择会导致双方密钥不一致；PSK方式不具备前向安全性
+
+// pskReply 客户端对 Cmd_PskHello 的回复数据
+type pskReply struct {
+	KeyID  string `json:"keyid"`
+	CNonce string `json:"cnonce"`
+	Mac    string `json:"mac"`
+}
+
+// pskConfirmMac 客户端证明持有密钥ID对应的密钥
+func pskConfirmMac(psk []byte, hello string, keyID string, cnonce string) []byte {
+	mac := hmac.New(sha256.New, hkdfExpand(psk, nil, "networker psk confirm", sha256.Size))
+	mac.Write(transcriptHash(hello, keyID, cnonce))
+	return mac.Sum(nil)
+}
+
+// serverPskExchange 服务端预共享密钥握手
+func (ptc *AesTcpClient) serverPskExchange(lsn *TcpListener) bool {
+	cmd := AesCmd{IsOK: true, Data: scramNonce(), Ext: ptc.serverOffer()}
+	jdata, _ := json.Marshal(cmd)
+	pkg, err := ptc.SendJsonAndWaitErr(ptc.GetNexPacSN(), Cmd_PskHello, string(jdata), nil, 3000)
+	if nil != err {
+		ptc.lastErr = err
+		return false
+	}
+
+	var ans struct {
+		AesCmd
+		Data pskReply `json:"data"`
+	}
+	err = json.Unmarshal([]byte(pkg.Json), &ans)
+	if nil != err {
+		ptc.lastErr = ErrKexRefused
+		return false
+	}
+	if !ans.IsOK {
+		ptc.lastErr = ErrPskDeclined
+		return false
+	}
+
+	psk := lsn.OnGetPsk(ans.Data.KeyID)
+	if len(psk) <= 0 {
+		ptc.lastErr = ErrUnknownPskID
+		return false
+	}
+
+	mac, err := hex.DecodeString(ans.Data.Mac)
+	if nil != err || !hmac.Equal(mac, pskConfirmMac(psk, string(jdata), ans.Data.KeyID, ans.Data.CNonce)) {
+		ptc.lastErr = ErrPskMismatch
+		return false
+	}
+
+	ptc.applyChoice(ans.Ext)
+	ptc.kexTranscript = transcriptHash(string(jdata), pkg.Json)
+	if nil != ans.Ext && len(ans.Ext.Suites) > 0 {
+		return ptc.negotiateSuite(psk, string(jdata), pkg.Json, ans.Ext.Suites)
+	}
+	if !ptc.legacySuiteAllowed(ptc.codec) {
+		ptc.lastErr = ErrNoCipherSuite
+		return false
+	}
+	ptc.setDerivedKeys(psk, transcriptHash(string(jdata), pkg.Json), 16)
+
+	return true
+}
+
+// onPskHello 客户端响应预共享密钥握手
+func (tcp *AesTcpClient) onPskHello(pkg *AesPackage) {
+	var cmd AesCmd
+	err := json.Unmarshal([]byte(pkg.Json), &cmd)
+	if nil != err {
+		tcp.audit(Audit_KexFailed, "", err.Error(), "psk")
+		return
+	}
+
+	//没有密钥时拒绝，由服务端决定改用ECC密钥交换或断开
+	rslt := AesCmd{}
+	if len(tcp.Psk) <= 0 {
+		rslt.Msg = "No pre-shared key"
+		tcp.ReplyJson(pkg, pkg.Cmd, rslt.ToJson(), nil)
+		return
+	}
+
+	cnonce := scramNonce()
+	rslt.IsOK = true
+	rslt.Data = pskReply{
+		KeyID:  tcp.PskID,
+		CNonce: cnonce,
+		Mac:    hex.EncodeToString(pskConfirmMac(tcp.Psk, pkg.Json, tcp.PskID, cnonce)),
+	}
+
+	var codec frameCodec
+	codec, rslt.Ext = tcp.acceptOffer(cmd.Ext)
+	nego := nil != rslt.Ext && len(rslt.Ext.Suites) > 0
+	if !nego && !tcp.legacySuiteAllowed(codec) {
+		tcp.lastErr = ErrNoCipherSuite
+		rslt = AesCmd{Msg: ErrNoCipherSuite.Error()}
+	}
+
+	jstr, err := json.Marshal(rslt)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onPskHello 结果转JSON异常", err)
+		return
+	}
+
+	tcp.ReplyJson(pkg, pkg.Cmd, string(jstr), nil)
+
+	if nil != tcp.lastErr {
+		tcp.audit(Audit_KexFailed, "", tcp.lastErr.Error(), "psk")
+		tcp.Close()
+		return
+	}
+	tcp.kexTranscript = transcriptHash(pkg.Json, string(jstr))
+
+	if nego {
+		tcp.pendingKex = &pendingKex{secret: tcp.Psk, hello: pkg.Json, reply: string(jstr), codec: codec}
+		return
+	}
+
+	tcp.codec = codec
+	tcp.setDerivedKeys(tcp.Psk, transcriptHash(pkg.Json, string(jstr)), 16)
+}
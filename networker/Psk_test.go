@@ -0,0 +1,77 @@
+package networker
+
+import (
+	"testing"
+)
+
+func testPskListener(t *testing.T, requirePsk bool, audit AuditSink) (int, chan *AesTcpClient) {
+	return testListener(t, func(lsnr *TcpListener) {
+		lsnr.RequirePsk = requirePsk
+		lsnr.Audit = audit
+		lsnr.OnGetPsk = func(keyID string) []byte {
+			if keyID == "k1" {
+				return []byte("0123456789abcdef0123456789abcdef")
+			}
+			return nil
+		}
+	})
+}
+
+func TestPskLogin(t *testing.T) {
+	port, ch := testPskListener(t, false, nil)
+
+	cli := NewAesTcpClient()
+	cli.PskID, cli.Psk = "k1", []byte("0123456789abcdef0123456789abcdef")
+	testLogin(t, cli, port)
+	svr := <-ch
+	if nil == svr || svr.GetCipherSuite() != cli.GetCipherSuite() {
+		t.Fatal("双方加密套件不一致")
+	}
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	testEcho(t, cli, 100)
+
+	//密钥错误、密钥ID不存在
+	for _, id := range []string{"k1", "k2"} {
+		bad := NewAesTcpClient()
+		bad.PskID, bad.Psk = id, []byte("wrong")
+		if bad.Login("127.0.0.1", port, "admin", "admin", 3000) {
+			t.Fatal("错误的预共享密钥登录成功", id)
+		}
+		<-ch
+		bad.Close()
+	}
+
+	//没有预共享密钥的客户端改用ECC密钥交换
+	ecc := NewAesTcpClient()
+	testLogin(t, ecc, port)
+	if nil == <-ch {
+		t.Fatal("服务端没有改用ECC密钥交换")
+	}
+	ecc.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	testEcho(t, ecc, 100)
+}
+
+func TestPskRequired(t *testing.T) {
+	log := &testAuditLog{}
+	port, ch := testPskListener(t, true, log)
+
+	//只允许PSK时断开没有密钥的客户端
+	cli := NewAesTcpClient()
+	if cli.Login("127.0.0.1", port, "admin", "admin", 3000) {
+		t.Fatal("没有预共享密钥登录成功")
+	}
+	if nil != <-ch {
+		t.Fatal("服务端接受了没有预共享密钥的客户端")
+	}
+	cli.Close()
+	if ev := log.wait(Audit_KexFailed); nil == ev || ev.Reason != ErrPskDeclined.Error() || ev.Detail != "psk" {
+		t.Fatal("密钥交换失败事件错误", ev)
+	}
+
+	cli = NewAesTcpClient()
+	cli.PskID, cli.Psk = "k1", []byte("0123456789abcdef0123456789abcdef")
+	testLogin(t, cli, port)
+	if nil == <-ch {
+		t.Fatal("服务端认证失败")
+	}
+}
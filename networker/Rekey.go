@@ -0,0 +1,234 @@
+package networker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	ecies "github.com/ecies/go/v2"
+)
+
+// 会话中更换密钥：
+//  1. 发起方生成临时ECC密钥，用当前密钥加密发送 Cmd_Rekey 请求
+//  2. 响应方生成新密钥材料，用发起方公钥加密后回复；响应方此时仍用旧密钥发送，新密钥待启用
+//  3. 发起方收到回复后由密钥材料派生两个方向的新密钥（代号+1）发送，并发送一个 Cmd_Rekey 通知帧
+//  4. 响应方收到第一个新代号且用新密钥解密成功的数据帧时启用新密钥，伪造或损坏的代号字节不会引起切换
+// 双方都保留最近几代旧密钥用于解密切换前已发出的数据帧，等待中的 SendJsonAndWait 不受影响
+
+var ErrUnknownKeyEpoch = errors.New("unknown key epoch")
+
+// keyHistory 保留的旧密钥代数，用于解密排队中或发送较晚的旧数据帧
+const keyHistory = 4
+
+// setSessionKeys 握手完成后设置初始密钥
+func (tcp *AesTcpClient) setSessionKeys(keys sessionKeys) {
+	tcp.keyLock.Lock()
+	defer tcp.keyLock.Unlock()
+
+	tcp.aesKey = keys.send
+	tcp.recvAesKey = keys.recv
+	tcp.keyEpoch = 0
+	tcp.oldKeys = [keyHistory][]byte{}
+	tcp.nextKeys = sessionKeys{}
+	tcp.resetRekeyCounter()
+}
+
+func (tcp *AesTcpClient) resetRekeyCounter() {
+	tcp.keyTime = time.Now()
+	tcp.keyBytes.Store(0)
+	tcp.keyFrames.Store(0)
+}
+
+// recvKey 当前接收密钥，没有会话密钥时为nil
+func (tcp *AesTcpClient) recvKey() []byte {
+	tcp.keyLock.RLock()
+	defer tcp.keyLock.RUnlock()
+
+	return tcp.recvAesKey
+}
+
+// sendKeyLen 当前发送密钥长度，没有会话密钥时为0
+func (tcp *AesTcpClient) sendKeyLen() int {
+	tcp.keyLock.RLock()
+	defer tcp.keyLock.RUnlock()
+
+	return len(tcp.aesKey)
+}
+
+// keyForEpoch 根据数据帧的密钥代号选择解密密钥；代号为待启用的新密钥时返回新密钥和true，
+// 此时只有用新密钥解密成功后才调用 commitNextKeys 启用
+func (tcp *AesTcpClient) keyForEpoch(epoch uint8) ([]byte, bool) {
+	tcp.keyLock.RLock()
+	defer tcp.keyLock.RUnlock()
+
+	if epoch == tcp.keyEpoch {
+		return tcp.recvAesKey, false
+	}
+	if epoch == tcp.keyEpoch+1 && nil != tcp.nextKeys.recv {
+		return tcp.nextKeys.recv, true
+	}
+	if back := tcp.keyEpoch - epoch; back <= keyHistory {
+		return tcp.oldKeys[epoch%keyHistory], false
+	}
+
+	return nil, false
+}
+
+// commitNextKeys 对端已用新密钥发送且数据帧解密成功，启用新密钥
+func (tcp *AesTcpClient) commitNextKeys(epoch uint8) {
+	tcp.keyLock.Lock()
+	defer tcp.keyLock.Unlock()
+
+	if epoch == tcp.keyEpoch+1 && nil != tcp.nextKeys.recv {
+		tcp.switchKeys(tcp.nextKeys)
+	}
+}
+
+// switchKeys 启用新一代密钥，调用方需持有keyLock
+func (tcp *AesTcpClient) switchKeys(keys sessionKeys) {
+	tcp.oldKeys[tcp.keyEpoch%keyHistory] = tcp.recvAesKey
+	tcp.aesKey = keys.send
+	tcp.recvAesKey = keys.recv
+	tcp.keyEpoch++
+	tcp.nextKeys = sessionKeys{}
+	tcp.resetRekeyCounter()
+
+	fmt.Println(tcp.ClientFlag, "AesTcpClient 启用新密钥 epoch=", tcp.keyEpoch)
+}
+
+// countRekey 统计当前密钥加密的数据量，达到条件时后台更换密钥
+func (tcp *AesTcpClient) countRekey(streamLen int) {
+	if !tcp.codec.rekey {
+		return
+	}
+
+	tcp.keyLock.RLock()
+	hasKey := nil != tcp.aesKey
+	keyTime := tcp.keyTime
+	tcp.keyLock.RUnlock()
+	if !hasKey {
+		return
+	}
+
+	bytes := tcp.keyBytes.Add(uint64(streamLen))
+	frames := tcp.keyFrames.Add(1)
+
+	if (tcp.RekeyBytes > 0 && bytes >= tcp.RekeyBytes) ||
+		(tcp.RekeyFrames > 0 && frames >= tcp.RekeyFrames) ||
+		(tcp.RekeyInterval > 0 && time.Since(keyTime) >= tcp.RekeyInterval) {
+		go tcp.Rekey()
+	}
+}
+
+// Rekey 发起一次会话密钥更换，已在更换中或对端不支持时返回false
+func (tcp *AesTcpClient) Rekey() bool {
+	keyLen := tcp.sendKeyLen()
+	if !tcp.codec.rekey || keyLen <= 0 {
+		return false
+	}
+
+	if !tcp.rekeyLock.TryLock() {
+		return false
+	}
+	defer tcp.rekeyLock.Unlock()
+
+	//对端发起的更换尚未完成时不能再发起，避免双方密钥代号不一致
+	tcp.keyLock.Lock()
+	pending := nil != tcp.nextKeys.recv
+	if !pending {
+		tcp.rekeying = true
+	}
+	tcp.keyLock.Unlock()
+	if pending {
+		return false
+	}
+	defer func() {
+		tcp.keyLock.Lock()
+		tcp.rekeying = false
+		tcp.keyLock.Unlock()
+	}()
+
+	ecc := ECC{}
+	ecc.initKey()
+	if nil == ecc.EccKey {
+		return false
+	}
+
+	cmd := AesCmd{IsOK: true, Data: ecc.EccKey.PublicKey.Hex(true)}
+	pkg := tcp.SendJsonAndWait(tcp.GetNexPacSN(), Cmd_Rekey, cmd.ToJson(), nil, 3000)
+	if nil == pkg {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.Rekey 没有收到回复")
+		return false
+	}
+
+	var rslt AesCmd
+	err := json.Unmarshal([]byte(pkg.Json), &rslt)
+	if nil != err || !rslt.IsOK {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.Rekey 对端拒绝", err, rslt.Msg)
+		return false
+	}
+
+	keyHex, _ := rslt.Data.(string)
+	data, err := hex.DecodeString(keyHex)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.Rekey 密钥数据错误", err)
+		return false
+	}
+
+	secret := ecc.Decrypt(data)
+	if len(secret) != keyLen {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.Rekey 解密新密钥失败")
+		return false
+	}
+
+	tcp.keyLock.Lock()
+	tcp.switchKeys(deriveSessionKeys(secret, nil, len(secret), tcp.isServer))
+	tcp.keyLock.Unlock()
+
+	//用新密钥发送通知帧，对端收到后启用新密钥
+	tcp.SendJson(tcp.GetNexPacSN(), Cmd_Rekey, (&AesCmd{IsOK: true}).ToJson(), nil)
+
+	return true
+}
+
+// onRekeyCmd 响应对端的密钥更换请求
+func (tcp *AesTcpClient) onRekeyCmd(pkg *AesPackage) {
+	var cmd AesCmd
+	err := json.Unmarshal([]byte(pkg.Json), &cmd)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onRekeyCmd json转对象异常", err)
+		return
+	}
+
+	pubHex, _ := cmd.Data.(string)
+	if len(pubHex) <= 0 {
+		//发起方的切换通知，解包时已启用新密钥
+		return
+	}
+
+	rslt := AesCmd{}
+
+	pubKey, err := ecies.NewPublicKeyFromHex(pubHex)
+	if nil != err {
+		rslt.Msg = err.Error()
+	} else {
+		ecc := ECC{}
+		secret := newAesKeyLen(tcp.sendKeyLen())
+		rslt.Data = hex.EncodeToString(ecc.Encrypt(secret, pubKey))
+		rslt.IsOK = true
+
+		//先记录待启用密钥再回复，避免对端切换后的数据帧先到
+		tcp.keyLock.Lock()
+		if tcp.isServer && tcp.rekeying {
+			//双方同时发起时以服务端为准
+			rslt = AesCmd{Msg: "Rekey in progress"}
+		} else {
+			tcp.nextKeys = deriveSessionKeys(secret, nil, len(secret), tcp.isServer)
+		}
+		tcp.keyLock.Unlock()
+	}
+
+	tcp.ReplyJson(pkg, Cmd_Rekey, rslt.ToJson(), nil)
+}
@@ -0,0 +1,71 @@
+package networker
+
+import (
+	"testing"
+)
+
+// testKeyEpoch 当前密钥代号
+func testKeyEpoch(tcp *AesTcpClient) uint8 {
+	tcp.keyLock.RLock()
+	defer tcp.keyLock.RUnlock()
+
+	return tcp.keyEpoch
+}
+
+func TestRekeyFrames(t *testing.T) {
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.RekeyFrames = 7
+	})
+
+	cli := NewAesTcpClient()
+	cli.RekeyFrames = 11
+	testLogin(t, cli, port)
+	svr := <-ch
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+
+	for idx := 0; idx < 100; idx++ {
+		testEcho(t, cli, 10)
+	}
+
+	//多个协程同时请求时双方交替更换密钥
+	fails := make(chan error, 300)
+	for g := 0; g < 10; g++ {
+		go func() {
+			for idx := 0; idx < 30; idx++ {
+				_, err := cli.SendJsonAndWaitErr(cli.GetNexPacSN(), Cmd_Test, "hello", nil, 3000)
+				fails <- err
+			}
+		}()
+	}
+	for idx := 0; idx < 300; idx++ {
+		if err := <-fails; nil != err {
+			t.Fatal("更换密钥期间请求失败", err)
+		}
+	}
+
+	if 0 == testKeyEpoch(cli) || 0 == testKeyEpoch(svr) {
+		t.Fatal("没有更换密钥", testKeyEpoch(cli), testKeyEpoch(svr))
+	}
+	if 0 != cli.GetReplayCount() || 0 != svr.GetReplayCount() {
+		t.Fatal("更换密钥后数据帧被拒绝", cli.GetReplayCount(), svr.GetReplayCount())
+	}
+}
+
+func TestRekeyManual(t *testing.T) {
+	port, ch := testListener(t, nil)
+
+	cli := NewAesTcpClient()
+	testLogin(t, cli, port)
+	svr := <-ch
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+
+	for idx := 1; idx <= 3; idx++ {
+		if !cli.Rekey() {
+			t.Fatal("更换密钥失败")
+		}
+		testEcho(t, cli, 1000)
+		if testKeyEpoch(cli) != uint8(idx) || testKeyEpoch(svr) != uint8(idx) {
+			t.Fatal("双方密钥代号不一致", testKeyEpoch(cli), testKeyEpoch(svr))
+		}
+	}
+}
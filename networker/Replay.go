@@ -0,0 +1,61 @@
+package networker
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrReplayedFrame 重放或超出接收窗口的数据帧
+var ErrReplayedFrame = errors.New("replayed or out-of-window frame")
+
+// replayWindowSize 接收窗口大小，允许并发发送造成的少量乱序
+const replayWindowSize = 64
+
+// replayWindow 滑动窗口防重放：记录已收到的最大序号及其之前窗口内序号的接收位图
+type replayWindow struct {
+	lock sync.Mutex
+	top  uint64
+	bits uint64
+}
+
+// accept 序号未收到过且在窗口内时记录并返回true
+func (w *replayWindow) accept(seq uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if 0 == seq {
+		return false
+	}
+
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= replayWindowSize {
+			w.bits = 1
+		} else {
+			w.bits = (w.bits << shift) | 1
+		}
+		w.top = seq
+		return true
+	}
+
+	offset := w.top - seq
+	if offset >= replayWindowSize {
+		return false
+	}
+
+	mask := uint64(1) << offset
+	if w.bits&mask != 0 {
+		return false
+	}
+
+	w.bits |= mask
+	return true
+}
+
+func (w *replayWindow) reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.top = 0
+	w.bits = 0
+}
@@ -0,0 +1,44 @@
+package networker
+
+import "testing"
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+
+	if w.accept(0) {
+		t.Fatal("序号0不应被接受")
+	}
+
+	for seq := uint64(1); seq <= 10; seq++ {
+		if !w.accept(seq) {
+			t.Fatal("顺序序号被拒绝", seq)
+		}
+	}
+	if w.accept(10) || w.accept(3) {
+		t.Fatal("重复序号被接受")
+	}
+
+	//窗口内乱序
+	if !w.accept(15) || !w.accept(12) || !w.accept(11) {
+		t.Fatal("窗口内乱序序号被拒绝")
+	}
+	if w.accept(12) {
+		t.Fatal("乱序后重复序号被接受")
+	}
+
+	//超出窗口的旧序号
+	if !w.accept(15 + replayWindowSize) {
+		t.Fatal("跳跃序号被拒绝")
+	}
+	if w.accept(15) || w.accept(14) {
+		t.Fatal("超出窗口的旧序号被接受")
+	}
+	if !w.accept(16) {
+		t.Fatal("窗口边界内未收到的序号被拒绝")
+	}
+
+	w.reset()
+	if !w.accept(1) {
+		t.Fatal("重置后序号被拒绝")
+	}
+}
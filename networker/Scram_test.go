@@ -0,0 +1,67 @@
+package networker
+
+import "testing"
+
+func scramExchange(t *testing.T, v *ScramVerifier, pwd string, cbind []byte) (*scramClient, *scramChallenge, *scramFinal) {
+	sc := newScramClient("alice", pwd)
+	ch := &scramChallenge{Salt: v.Salt, Iter: v.Iter, Nonce: sc.first().CNonce + scramNonce()}
+
+	final, err := sc.final(ch, cbind)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	return sc, ch, final
+}
+
+func TestScramProof(t *testing.T) {
+	v := NewScramVerifier("secret", 1000)
+	cbind := []byte("channel binding")
+
+	sc, ch, final := scramExchange(t, v, "secret", cbind)
+	serverSig, ok := scramVerifyProof(v, scramAuthMessage("alice", sc.cnonce, ch, cbind), final.Proof)
+	if !ok {
+		t.Fatal("正确口令的证明校验失败")
+	}
+	if !sc.verifyServer(serverSig) {
+		t.Fatal("服务端签名校验失败")
+	}
+
+	//口令错误
+	sc, ch, final = scramExchange(t, v, "wrong", cbind)
+	if _, ok = scramVerifyProof(v, scramAuthMessage("alice", sc.cnonce, ch, cbind), final.Proof); ok {
+		t.Fatal("错误口令的证明通过校验")
+	}
+
+	//证明绑定会话，不能用于其他连接
+	sc, ch, final = scramExchange(t, v, "secret", cbind)
+	if _, ok = scramVerifyProof(v, scramAuthMessage("alice", sc.cnonce, ch, []byte("other")), final.Proof); ok {
+		t.Fatal("其他会话的证明通过校验")
+	}
+
+	//证明被修改或长度错误
+	final.Proof[0] ^= 1
+	if _, ok = scramVerifyProof(v, scramAuthMessage("alice", sc.cnonce, ch, cbind), final.Proof); ok {
+		t.Fatal("修改后的证明通过校验")
+	}
+	if _, ok = scramVerifyProof(v, scramAuthMessage("alice", sc.cnonce, ch, cbind), final.Proof[:16]); ok {
+		t.Fatal("长度错误的证明通过校验")
+	}
+	if _, ok = scramVerifyProof(nil, "", make([]byte, 32)); ok {
+		t.Fatal("没有验证数据时通过校验")
+	}
+
+	//服务端签名不一致
+	if sc.verifyServer(serverSig) || (&scramClient{}).verifyServer(nil) {
+		t.Fatal("错误的服务端签名通过校验")
+	}
+
+	//挑战中的随机数必须以客户端随机数开头
+	if _, err := newScramClient("alice", "secret").final(&scramChallenge{Salt: v.Salt, Iter: v.Iter, Nonce: scramNonce() + scramNonce()}, cbind); nil == err {
+		t.Fatal("随机数不匹配的挑战被接受")
+	}
+
+	if !v.VerifyPassword("secret") || v.VerifyPassword("wrong") {
+		t.Fatal("VerifyPassword 结果错误")
+	}
+}
@@ -0,0 +1,161 @@
+package networker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 会话令牌：认证成功后服务端签发带有效期的令牌，客户端重连时出示令牌即可跳过口令步骤
+// 令牌格式为 base64url(JSON内容).base64url(HMAC-SHA256签名)，服务端不需要保存已签发的令牌
+
+const (
+	authNameToken = "token"
+
+	DefaultTokenLifetime = 24 * time.Hour
+)
+
+var (
+	ErrTokenInvalid = errors.New("session token is invalid")
+	ErrTokenExpired = errors.New("session token is expired")
+	ErrTokenRevoked = errors.New("session token is revoked")
+)
+
+// tokenClaims 令牌内容
+type tokenClaims struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	AuthMethod string `json:"auth"`          //首次登录使用的认证方式
+	DeviceKey  string `json:"dev,omitempty"` //设备公钥指纹
+	IssuedAt   int64  `json:"iat"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// TokenIssuer 签发和校验会话令牌
+type TokenIssuer struct {
+	key      []byte
+	Lifetime time.Duration //令牌有效期，为0时使用 DefaultTokenLifetime
+
+	lock        sync.Mutex
+	revoked     map[string]int64     //吊销的令牌ID -> 过期时间，过期后清除
+	userRevoked map[string]time.Time //用户 -> 吊销时间，此前签发的令牌全部失效
+}
+
+// NewTokenIssuer key为签名密钥，为空时随机生成（服务重启后已签发的令牌失效）
+func NewTokenIssuer(key []byte, lifetime time.Duration) *TokenIssuer {
+	if len(key) <= 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+
+	return &TokenIssuer{
+		key:         key,
+		Lifetime:    lifetime,
+		revoked:     make(map[string]int64),
+		userRevoked: make(map[string]time.Time),
+	}
+}
+
+func (ti *TokenIssuer) sign(payload string) string {
+	mac := hmac.New(sha256.New, ti.key)
+	mac.Write([]byte("networker token:" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue 为认证成功的用户签发令牌
+func (ti *TokenIssuer) issue(user *LoginUserInfo) string {
+	lifetime := ti.Lifetime
+	if lifetime <= 0 {
+		lifetime = DefaultTokenLifetime
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	now := time.Now()
+	claims := tokenClaims{
+		ID:         hex.EncodeToString(id),
+		Name:       user.Name,
+		AuthMethod: user.AuthMethod,
+		DeviceKey:  user.DeviceKey,
+		IssuedAt:   now.UnixNano(),
+		ExpiresAt:  now.Add(lifetime).UnixNano(),
+	}
+
+	data, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+
+	return payload + "." + ti.sign(payload)
+}
+
+// verify 校验令牌签名、有效期和吊销状态
+func (ti *TokenIssuer) verify(token string) (*tokenClaims, error) {
+	payload, sig, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(sig), []byte(ti.sign(payload))) {
+		return nil, ErrTokenInvalid
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if nil != err {
+		return nil, ErrTokenInvalid
+	}
+
+	var claims tokenClaims
+	err = json.Unmarshal(data, &claims)
+	if nil != err || len(claims.Name) <= 0 {
+		return nil, ErrTokenInvalid
+	}
+
+	if time.Now().UnixNano() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	if _, has := ti.revoked[claims.ID]; has {
+		return nil, ErrTokenRevoked
+	}
+	if tm, has := ti.userRevoked[claims.Name]; has && claims.IssuedAt <= tm.UnixNano() {
+		return nil, ErrTokenRevoked
+	}
+
+	return &claims, nil
+}
+
+// Revoke 吊销一个令牌，令牌无效时返回false
+func (ti *TokenIssuer) Revoke(token string) bool {
+	claims, err := ti.verify(token)
+	if nil != err {
+		return false
+	}
+
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	//顺便清除已过期的吊销记录
+	now := time.Now().UnixNano()
+	for id, exp := range ti.revoked {
+		if now >= exp {
+			delete(ti.revoked, id)
+		}
+	}
+	ti.revoked[claims.ID] = claims.ExpiresAt
+
+	return true
+}
+
+// RevokeUser 吊销用户此前签发的全部令牌
+func (ti *TokenIssuer) RevokeUser(name string) {
+	ti.lock.Lock()
+	defer ti.lock.Unlock()
+
+	ti.userRevoked[name] = time.Now()
+}
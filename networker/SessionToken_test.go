@@ -0,0 +1,96 @@
+package networker
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenLogin(t *testing.T) {
+	tokens := NewTokenIssuer(nil, time.Hour)
+	var checks atomic.Int32
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.Tokens = tokens
+		lsnr.OnAuthorize = func(name string, pwd string) bool {
+			checks.Add(1)
+			return name == "admin" && pwd == "admin"
+		}
+	})
+
+	cli := NewAesTcpClient()
+	testLogin(t, cli, port)
+	<-ch
+	token := cli.SessionToken
+	if len(token) <= 0 {
+		t.Fatal("没有签发会话令牌")
+	}
+	cli.Close()
+
+	//令牌有效时不再校验口令
+	if !cli.Login("127.0.0.1", port, "admin", "bad", 3000) || 1 != checks.Load() {
+		t.Fatal("令牌登录失败", checks.Load())
+	}
+	if svr := <-ch; nil == svr || svr.User.AuthMethod != authNameToken {
+		t.Fatal("服务端认证方式错误")
+	}
+	cli.Close()
+
+	//吊销令牌后改用口令登录并签发新令牌
+	tokens.Revoke(token)
+	if !cli.Login("127.0.0.1", port, "admin", "admin", 3000) || 2 != checks.Load() || cli.SessionToken == token {
+		t.Fatal("令牌吊销后没有改用口令", checks.Load())
+	}
+	<-ch
+	cli.Close()
+
+	//吊销用户的全部令牌
+	tokens.RevokeUser("admin")
+	if cli.Login("127.0.0.1", port, "admin", "bad", 3000) {
+		t.Fatal("吊销的令牌登录成功")
+	}
+	if nil != <-ch || len(cli.SessionToken) > 0 {
+		t.Fatal("吊销的令牌没有被清除")
+	}
+}
+
+func TestTokenVerify(t *testing.T) {
+	tokens := NewTokenIssuer([]byte("key"), time.Millisecond)
+	token := tokens.issue(&LoginUserInfo{Name: "admin"})
+
+	if _, err := tokens.verify(token + "x"); err != ErrTokenInvalid {
+		t.Fatal("应返回 ErrTokenInvalid", err)
+	}
+	if _, err := NewTokenIssuer([]byte("other"), time.Hour).verify(token); err != ErrTokenInvalid {
+		t.Fatal("其它密钥签发的令牌应返回 ErrTokenInvalid", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := tokens.verify(token); err != ErrTokenExpired {
+		t.Fatal("应返回 ErrTokenExpired", err)
+	}
+}
+
+func TestTokenDeviceRevoked(t *testing.T) {
+	devices := NewDeviceStore()
+	key := &ECC{}
+	devices.Register("dev1", key.GetPubKey())
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.Tokens = NewTokenIssuer(nil, time.Hour)
+		lsnr.OnGetDeviceKey = devices.Get
+	})
+
+	cli := NewAesTcpClient()
+	cli.DeviceKey = key
+	if !cli.Login("127.0.0.1", port, "dev1", "", 3000) || len(cli.SessionToken) <= 0 {
+		t.Fatal("设备登录失败")
+	}
+	<-ch
+	cli.Close()
+
+	//吊销设备后其令牌随之失效
+	devices.Revoke("dev1")
+	cli.DeviceKey = nil
+	if cli.Login("127.0.0.1", port, "dev1", "", 3000) {
+		t.Fatal("吊销设备的令牌登录成功")
+	}
+	<-ch
+}
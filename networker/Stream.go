@@ -0,0 +1,576 @@
+package networker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// 数据流：大数据拆分为多个数据帧发送，双方都不需要在内存中组装完整的ExtData
+//  1. 发送方分配流ID，发送 Cmd_StreamOpen（携带业务cmd和Json）并等待回复，接收方回复接收窗口大小
+//  2. 发送方用 Cmd_StreamData 发送数据块（Json为流ID，ExtData为数据），已发送未确认的字节数不超过窗口
+//  3. 接收方应用读取数据后用 Cmd_StreamAck 确认读取的字节数，发送方据此继续发送，实现背压
+//  4. 发送方用带eof的 Cmd_StreamData 结束；带reason的 Cmd_StreamData 表示发送方中止，带reason的 Cmd_StreamAck 表示接收方中止
+// 流ID由发送方分配，两个方向各自独立。流控制帧和普通数据帧一样在包处理协程中处理，
+// 因此不能在包处理回调中调用 SendStream，接收方的 OnStream 回调在单独的协程中执行
+
+var (
+	ErrStreamUnsupported = errors.New("peer does not support streams")
+	ErrStreamRejected    = errors.New("stream rejected by peer")
+	ErrStreamAborted     = errors.New("stream aborted")
+	ErrStreamClosed      = errors.New("stream connection closed")
+)
+
+const (
+	DefaultStreamWindow = 1024 * 1024            //默认接收窗口（字节）
+	streamChunkSize     = 64 * 1024              //每个数据帧的最大数据长度
+	maxRecvStreams      = 64                     //同时接收的流数量上限
+	streamPollInterval  = 200 * time.Millisecond //等待期间检查连接状态的间隔
+)
+
+// streamCmd 流控制消息
+type streamCmd struct {
+	ID     uint32 `json:"id"`
+	Cmd    uint16 `json:"cmd,omitempty"`    //Cmd_StreamOpen：业务命令
+	Json   string `json:"json,omitempty"`   //Cmd_StreamOpen：业务数据
+	Size   uint32 `json:"n,omitempty"`      //Cmd_StreamAck：应用已读取的字节数
+	EOF    bool   `json:"eof,omitempty"`    //Cmd_StreamData：数据结束
+	Reason string `json:"reason,omitempty"` //中止原因
+}
+
+func (cmd *streamCmd) toJson() string {
+	jdata, err := json.Marshal(cmd)
+	if nil != err {
+		fmt.Println("streamCmd.toJson 异常", err)
+		return ""
+	}
+
+	return string(jdata)
+}
+
+// streamTable 连接上进行中的流
+type streamTable struct {
+	lock   sync.Mutex
+	nextID uint32
+	send   map[uint32]*StreamWriter
+	recv   map[uint32]*StreamReader
+}
+
+// addSend 分配流ID并登记发送流
+func (t *streamTable) addSend(w *StreamWriter) uint32 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if nil == t.send {
+		t.send = make(map[uint32]*StreamWriter)
+	}
+	for {
+		t.nextID++
+		if _, used := t.send[t.nextID]; 0 != t.nextID && !used {
+			break
+		}
+	}
+	t.send[t.nextID] = w
+
+	return t.nextID
+}
+
+// addRecv 登记接收流，ID重复或超过数量上限时返回false
+func (t *streamTable) addRecv(r *StreamReader) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if nil == t.recv {
+		t.recv = make(map[uint32]*StreamReader)
+	}
+	if _, used := t.recv[r.id]; used || len(t.recv) >= maxRecvStreams {
+		return false
+	}
+	t.recv[r.id] = r
+
+	return true
+}
+
+func (t *streamTable) getSend(id uint32) *StreamWriter {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.send[id]
+}
+
+func (t *streamTable) getRecv(id uint32) *StreamReader {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.recv[id]
+}
+
+func (t *streamTable) removeSend(id uint32) {
+	t.lock.Lock()
+	delete(t.send, id)
+	t.lock.Unlock()
+}
+
+func (t *streamTable) removeRecv(id uint32) {
+	t.lock.Lock()
+	delete(t.recv, id)
+	t.lock.Unlock()
+}
+
+// closeAll 结束所有进行中的流，重新登录时使用
+func (t *streamTable) closeAll(err error) {
+	t.lock.Lock()
+	send, recv := t.send, t.recv
+	t.send, t.recv = nil, nil
+	t.lock.Unlock()
+
+	for _, w := range send {
+		w.fail(err)
+	}
+	for _, r := range recv {
+		r.fail(err)
+	}
+}
+
+// wakeUp 唤醒等待中的读写方，不阻塞
+func wakeUp(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// streamWait 等待唤醒或超时，返回连接是否仍然有效
+func (tcp *AesTcpClient) streamWait(wake chan struct{}) bool {
+	select {
+	case <-wake:
+	case <-time.After(streamPollInterval):
+	}
+
+	return tcp.IsConnected()
+}
+
+func abortError(reason string) error {
+	return fmt.Errorf("%w: %s", ErrStreamAborted, reason)
+}
+
+// StreamWriter 发送流，由 OpenStream 创建
+type StreamWriter struct {
+	tcp    *AesTcpClient
+	id     uint32
+	lock   sync.Mutex
+	credit int   //还可以发送的字节数
+	err    error //流已结束的原因，正常结束为 io.ErrClosedPipe
+	wake   chan struct{}
+}
+
+// OpenStream 打开发送流，cmd和json随打开请求发送，接收方在 OnStream 回调中收到；
+// 发送完成后必须调用 Close 或 Abort
+func (tcp *AesTcpClient) OpenStream(cmd uint16, jsonStr string) (*StreamWriter, error) {
+	if !tcp.HasCapability(Cap_Stream) {
+		return nil, ErrStreamUnsupported
+	}
+
+	w := &StreamWriter{tcp: tcp, wake: make(chan struct{}, 1)}
+	w.id = tcp.streams.addSend(w)
+
+	open := streamCmd{ID: w.id, Cmd: cmd, Json: jsonStr}
+	pkg := tcp.SendJsonAndWait(tcp.GetNexPacSN(), Cmd_StreamOpen, open.toJson(), nil, 3000)
+	if nil == pkg {
+		tcp.streams.removeSend(w.id)
+		if !tcp.IsConnected() {
+			return nil, ErrStreamClosed
+		}
+		return nil, fmt.Errorf("%w: no reply", ErrStreamRejected)
+	}
+
+	var rslt AesCmd
+	err := json.Unmarshal([]byte(pkg.Json), &rslt)
+	window, _ := rslt.Data.(float64)
+	if nil != err || !rslt.IsOK || window < 1 {
+		tcp.streams.removeSend(w.id)
+		return nil, fmt.Errorf("%w: %s", ErrStreamRejected, rslt.Msg)
+	}
+
+	w.lock.Lock()
+	w.credit += int(window)
+	w.lock.Unlock()
+
+	return w, nil
+}
+
+// SendStream 把r中的数据作为一个流发送，读完r后正常结束；读取失败时中止流并返回读取错误。
+// 接收方读取较慢时阻塞等待
+func (tcp *AesTcpClient) SendStream(cmd uint16, jsonStr string, r io.Reader) error {
+	w, err := tcp.OpenStream(cmd, jsonStr)
+	if nil != err {
+		return err
+	}
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if _, err = w.Write(buf[:n]); nil != err {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			return w.Close()
+		}
+		if nil != rerr {
+			w.Abort(rerr.Error())
+			return rerr
+		}
+	}
+}
+
+// ID 流ID
+func (w *StreamWriter) ID() uint32 {
+	return w.id
+}
+
+// Write 发送数据，接收窗口已满时阻塞到接收方读取、流被中止或连接断开
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n, err := w.waitCredit(len(p))
+		if nil != err {
+			return total, err
+		}
+
+		frame := streamCmd{ID: w.id}
+		if !w.tcp.SendJson(w.tcp.GetNexPacSN(), Cmd_StreamData, frame.toJson(), p[:n]) {
+			w.finish(ErrStreamClosed)
+			return total, ErrStreamClosed
+		}
+
+		total += n
+		p = p[n:]
+	}
+
+	return total, nil
+}
+
+// waitCredit 等待接收窗口有空间，返回本次可以发送的字节数
+func (w *StreamWriter) waitCredit(want int) (int, error) {
+	for {
+		w.lock.Lock()
+		if nil != w.err {
+			err := w.err
+			w.lock.Unlock()
+			return 0, err
+		}
+		if w.credit > 0 {
+			n := want
+			if n > w.credit {
+				n = w.credit
+			}
+			if n > streamChunkSize {
+				n = streamChunkSize
+			}
+			w.credit -= n
+			w.lock.Unlock()
+			return n, nil
+		}
+		w.lock.Unlock()
+
+		if !w.tcp.streamWait(w.wake) {
+			w.finish(ErrStreamClosed)
+		}
+	}
+}
+
+// Close 正常结束流，流已被中止时返回中止原因
+func (w *StreamWriter) Close() error {
+	if err := w.end(); nil != err {
+		if err == io.ErrClosedPipe {
+			return nil
+		}
+		return err
+	}
+
+	frame := streamCmd{ID: w.id, EOF: true}
+	if !w.tcp.SendJson(w.tcp.GetNexPacSN(), Cmd_StreamData, frame.toJson(), nil) {
+		return ErrStreamClosed
+	}
+
+	return nil
+}
+
+// Abort 中止流并通知接收方
+func (w *StreamWriter) Abort(reason string) {
+	if nil != w.end() {
+		return
+	}
+
+	if len(reason) <= 0 {
+		reason = "aborted"
+	}
+	frame := streamCmd{ID: w.id, Reason: reason}
+	w.tcp.SendJson(w.tcp.GetNexPacSN(), Cmd_StreamData, frame.toJson(), nil)
+}
+
+// end 标记流已结束，流之前已结束时返回结束原因（已正常结束为 io.ErrClosedPipe）
+func (w *StreamWriter) end() error {
+	w.tcp.streams.removeSend(w.id)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if nil != w.err {
+		return w.err
+	}
+	w.err = io.ErrClosedPipe
+
+	return nil
+}
+
+func (w *StreamWriter) finish(err error) {
+	w.tcp.streams.removeSend(w.id)
+	w.fail(err)
+}
+
+func (w *StreamWriter) fail(err error) {
+	w.lock.Lock()
+	if nil == w.err {
+		w.err = err
+	}
+	w.lock.Unlock()
+
+	wakeUp(w.wake)
+}
+
+// StreamReader 接收流，在 OnStream 回调中使用，回调返回后自动关闭
+type StreamReader struct {
+	tcp     *AesTcpClient
+	id      uint32
+	window  int
+	lock    sync.Mutex
+	bufs    [][]byte //已收到未读取的数据块
+	size    int      //已收到未读取的字节数
+	unacked int      //已读取未确认的字节数
+	eof     bool
+	err     error
+	wake    chan struct{}
+}
+
+// ID 流ID（发送方分配）
+func (r *StreamReader) ID() uint32 {
+	return r.id
+}
+
+// Read 读取数据，没有数据时阻塞到收到数据、流结束、被中止或连接断开
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for {
+		r.lock.Lock()
+		if nil != r.err {
+			err := r.err
+			r.lock.Unlock()
+			return 0, err
+		}
+
+		if r.size > 0 {
+			n := 0
+			for n < len(p) && len(r.bufs) > 0 {
+				c := copy(p[n:], r.bufs[0])
+				n += c
+				if c < len(r.bufs[0]) {
+					r.bufs[0] = r.bufs[0][c:]
+				} else {
+					r.bufs[0] = nil
+					r.bufs = r.bufs[1:]
+				}
+			}
+			r.size -= n
+			r.unacked += n
+
+			//确认过于频繁会增加帧数，过少会让发送方等待，读取量达到窗口的1/4时确认
+			ack := 0
+			if !r.eof && r.unacked >= r.window/4 {
+				ack = r.unacked
+				r.unacked = 0
+			}
+			r.lock.Unlock()
+
+			if ack > 0 {
+				frame := streamCmd{ID: r.id, Size: uint32(ack)}
+				r.tcp.SendJson(r.tcp.GetNexPacSN(), Cmd_StreamAck, frame.toJson(), nil)
+			}
+
+			return n, nil
+		}
+
+		if r.eof {
+			r.lock.Unlock()
+			return 0, io.EOF
+		}
+		r.lock.Unlock()
+
+		if !r.tcp.streamWait(r.wake) {
+			r.tcp.streams.removeRecv(r.id)
+			r.fail(ErrStreamClosed)
+		}
+	}
+}
+
+// Abort 中止接收并通知发送方，未读取的数据被丢弃
+func (r *StreamReader) Abort(reason string) {
+	r.tcp.streams.removeRecv(r.id)
+
+	r.lock.Lock()
+	active := nil == r.err && !r.eof
+	r.lock.Unlock()
+
+	if len(reason) <= 0 {
+		reason = "aborted"
+	}
+	r.fail(abortError(reason))
+
+	if active {
+		frame := streamCmd{ID: r.id, Reason: reason}
+		r.tcp.SendJson(r.tcp.GetNexPacSN(), Cmd_StreamAck, frame.toJson(), nil)
+	}
+}
+
+// Close 结束读取，数据未读完时中止流
+func (r *StreamReader) Close() error {
+	r.lock.Lock()
+	done := nil != r.err || (r.eof && r.size <= 0)
+	r.lock.Unlock()
+
+	if !done {
+		r.Abort("closed by receiver")
+	}
+
+	return nil
+}
+
+func (r *StreamReader) fail(err error) {
+	r.lock.Lock()
+	if nil == r.err {
+		r.err = err
+		r.bufs = nil
+		r.size = 0
+	}
+	r.lock.Unlock()
+
+	wakeUp(r.wake)
+}
+
+// onStreamOpen 接收方处理打开请求，按业务cmd检查命令权限
+func (tcp *AesTcpClient) onStreamOpen(pkg *AesPackage) {
+	var open streamCmd
+	err := json.Unmarshal([]byte(pkg.Json), &open)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamOpen json转对象异常", err)
+		return
+	}
+
+	if !tcp.checkCmdPolicy(&AesPackage{PacSN: pkg.PacSN, Cmd: open.Cmd, CorrID: pkg.CorrID}) {
+		return
+	}
+
+	handler := tcp.OnStream
+	window := tcp.StreamWindow
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+	r := &StreamReader{tcp: tcp, id: open.ID, window: window, wake: make(chan struct{}, 1)}
+
+	rslt := AesCmd{}
+	if nil == handler {
+		rslt.Msg = "Stream not accepted"
+	} else if !tcp.streams.addRecv(r) {
+		rslt.Msg = "Too many streams"
+	} else {
+		rslt.IsOK = true
+		rslt.Data = window
+	}
+	tcp.ReplyJson(pkg, pkg.Cmd, rslt.ToJson(), nil)
+
+	if !rslt.IsOK {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamOpen 拒绝数据流 id=", open.ID, " Cmd=", open.Cmd, rslt.Msg)
+		return
+	}
+
+	go func() {
+		defer r.Close()
+		handler(tcp, &AesPackage{PacSN: pkg.PacSN, Cmd: open.Cmd, Json: open.Json}, r)
+	}()
+}
+
+// onStreamData 接收方收到数据块、结束或中止通知
+func (tcp *AesTcpClient) onStreamData(pkg *AesPackage) {
+	var frame streamCmd
+	err := json.Unmarshal([]byte(pkg.Json), &frame)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamData json转对象异常", err)
+		return
+	}
+
+	r := tcp.streams.getRecv(frame.ID)
+	if nil == r {
+		//已中止的流，忽略对端发送中的数据
+		return
+	}
+
+	if len(frame.Reason) > 0 {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamData 发送方中止数据流 id=", frame.ID, frame.Reason)
+		tcp.streams.removeRecv(frame.ID)
+		r.fail(abortError(frame.Reason))
+		return
+	}
+
+	r.lock.Lock()
+	overflow := r.size+r.unacked+len(pkg.ExtData) > r.window
+	if !overflow && nil == r.err {
+		if len(pkg.ExtData) > 0 {
+			r.bufs = append(r.bufs, pkg.ExtData)
+			r.size += len(pkg.ExtData)
+		}
+		r.eof = frame.EOF
+	}
+	r.lock.Unlock()
+
+	if overflow {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamData 发送方超出接收窗口 id=", frame.ID)
+		r.Abort("window exceeded")
+		return
+	}
+	if frame.EOF {
+		tcp.streams.removeRecv(frame.ID)
+	}
+
+	wakeUp(r.wake)
+}
+
+// onStreamAck 发送方收到读取确认或接收方的中止通知
+func (tcp *AesTcpClient) onStreamAck(pkg *AesPackage) {
+	var frame streamCmd
+	err := json.Unmarshal([]byte(pkg.Json), &frame)
+	if nil != err {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamAck json转对象异常", err)
+		return
+	}
+
+	w := tcp.streams.getSend(frame.ID)
+	if nil == w {
+		return
+	}
+
+	if len(frame.Reason) > 0 {
+		fmt.Println(tcp.ClientFlag, "AesTcpClient.onStreamAck 接收方中止数据流 id=", frame.ID, frame.Reason)
+		w.finish(abortError(frame.Reason))
+		return
+	}
+
+	w.lock.Lock()
+	w.credit += int(frame.Size)
+	w.lock.Unlock()
+
+	wakeUp(w.wake)
+}
@@ -0,0 +1,133 @@
+package networker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type streamResult struct {
+	cmd  uint16
+	json string
+	sum  [32]byte
+	n    int
+	err  error
+}
+
+// testStreamReceiver 读完数据流并返回摘要；Json为"abort"时读取一部分后中止
+func testStreamReceiver(results chan streamResult) func(tcp *AesTcpClient, pkg *AesPackage, stream *StreamReader) {
+	return func(tcp *AesTcpClient, pkg *AesPackage, stream *StreamReader) {
+		h := sha256.New()
+		buf := make([]byte, 10000)
+		rslt := streamResult{cmd: pkg.Cmd, json: pkg.Json}
+		for {
+			if pkg.Json == "abort" && rslt.n > 100000 {
+				stream.Abort("no space")
+				results <- rslt
+				return
+			}
+
+			n, err := stream.Read(buf)
+			h.Write(buf[:n])
+			rslt.n += n
+			if nil != err {
+				if err != io.EOF {
+					rslt.err = err
+				}
+				copy(rslt.sum[:], h.Sum(nil))
+				results <- rslt
+				return
+			}
+		}
+	}
+}
+
+func testStreamCheck(t *testing.T, results chan streamResult, data []byte) {
+	select {
+	case rslt := <-results:
+		if nil != rslt.err || rslt.cmd != Cmd_Test || rslt.json != "file" || rslt.n != len(data) || rslt.sum != sha256.Sum256(data) {
+			t.Fatal("接收的数据流错误", rslt.err, rslt.n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("没有收到数据流")
+	}
+}
+
+func TestStreamCallback(t *testing.T) {
+	results := make(chan streamResult, 4)
+	port, _ := testListener(t, func(lsnr *TcpListener) {
+		lsnr.StreamWindow = 64 * 1024
+		lsnr.OnStream = testStreamReceiver(results)
+	})
+
+	cli := NewAesTcpClient()
+	testLogin(t, cli, port)
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+
+	//超过接收窗口，需要对端确认后继续发送
+	data := testExtData(1024*1024 + 123)
+	if err := cli.SendStream(Cmd_Test, "file", bytes.NewReader(data)); nil != err {
+		t.Fatal("发送数据流失败", err)
+	}
+	testStreamCheck(t, results, data)
+
+	//接收方中止
+	err := cli.SendStream(Cmd_Test, "abort", bytes.NewReader(data))
+	<-results
+	if !errors.Is(err, ErrStreamAborted) {
+		t.Fatal("应返回 ErrStreamAborted", err)
+	}
+
+	//接收方没有设置 OnStream
+	port, _ = testListener(t, nil)
+	cli = NewAesTcpClient()
+	testLogin(t, cli, port)
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	if err = cli.SendStream(Cmd_Test, "file", bytes.NewReader(data)); !errors.Is(err, ErrStreamRejected) {
+		t.Fatal("应返回 ErrStreamRejected", err)
+	}
+}
+
+// testReadLoop 用 ReadAesPackage 方式收包直到连接关闭，内部命令在读取时处理
+func testReadLoop(tcp *AesTcpClient, got chan *AesPackage) {
+	for tcp.IsConnected() {
+		if pkg := tcp.readAesPackage(500); nil != pkg {
+			got <- pkg
+		}
+	}
+}
+
+func TestStreamReadLoop(t *testing.T) {
+	results := make(chan streamResult, 4)
+	port, ch := testListenerHandler(t, func(lsnr *TcpListener) {
+		lsnr.StreamWindow = 64 * 1024
+		lsnr.OnStream = testStreamReceiver(results)
+	}, nil)
+
+	//双方都不设置回调，打开、数据和确认帧都由读取循环处理
+	cli := NewAesTcpClient()
+	testLogin(t, cli, port)
+	svr := <-ch
+	svrGot := make(chan *AesPackage, 16)
+	cliGot := make(chan *AesPackage, 16)
+	go testReadLoop(svr, svrGot)
+	go testReadLoop(cli, cliGot)
+
+	data := testExtData(512*1024 + 7)
+	if err := cli.SendStream(Cmd_Test, "file", bytes.NewReader(data)); nil != err {
+		t.Fatal("发送数据流失败", err)
+	}
+	testStreamCheck(t, results, data)
+
+	//数据流的帧不交给调用方
+	select {
+	case pkg := <-svrGot:
+		t.Fatal("服务端读取到数据流的帧", pkg.Cmd)
+	case pkg := <-cliGot:
+		t.Fatal("客户端读取到数据流的帧", pkg.Cmd)
+	default:
+	}
+}
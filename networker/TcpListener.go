@@ -1,57 +1,121 @@
 package networker
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
+
+	ecies "github.com/ecies/go/v2"
 )
 
 type TcpListener struct {
-	lsener           *net.Listener
+	lsener           atomic.Pointer[net.Listener] //Stop时置空，接受协程据此退出
 	OnClientAccepted func(*net.Conn)
 	OnAuthorize      func(name string, pwd string) bool
+	Authenticator    Authenticator             //设置后代替OnAuthorize校验口令，并为所有认证方式提供用户身份
+	TLSConfig        *tls.Config               //设置后使用TLS传输并跳过ECC/AES层，需要客户端证书时设置ClientAuth
+	EnableGcm        bool                      //向不支持套件协商的客户端提供AES-128-GCM，否则使用AES-CBC
+	CipherSuites     []string                  //加密套件选择策略（按优先顺序），为空时使用 DefaultCipherSuites
+	RequireAead      bool                      //严格模式：拒绝不支持套件协商且只能使用AES-CBC的旧客户端，默认兼容并输出 Audit_LegacyCipher 事件
+	EnableEcdh       bool                      //向客户端提供ECDH密钥交换，会话密钥具有前向安全性
+	OnGetPsk         func(keyID string) []byte //设置后先向客户端提供预共享密钥握手，客户端没有密钥时改用ECC密钥交换；返回nil表示密钥ID不存在
+	RequirePsk       bool                      //只允许预共享密钥握手，断开没有密钥的客户端
+	Identity         *ECC                      //服务端长期身份密钥（用 LoadOrCreateECC 加载），用于签名每个连接的临时公钥，防止中间人替换
+	IdentityKeys     *IdentityKeyRing          //设置后代替Identity，支持密钥轮换，过渡期内同时发送新旧密钥的签名
+
+	//获取用户的SCRAM验证数据，设置后向客户端提供SCRAM认证；用户不存在返回nil
+	OnGetVerifier func(name string) *ScramVerifier
+	RequireScram  bool //只允许SCRAM认证，拒绝明文口令
+
+	//获取登记的设备公钥，设置后向客户端提供设备公钥认证；设备不存在或已吊销返回nil，可使用 DeviceStore.Get
+	OnGetDeviceKey func(name string) *ecies.PublicKey
+
+	Tokens *TokenIssuer //设置后认证成功时签发会话令牌，客户端重连时可用令牌登录
+	Guard  *LoginGuard  //设置后按来源IP和用户名统计认证失败，延迟回复并临时锁定
+	Policy *CmdPolicy   //设置后按登录用户的角色检查对端请求的命令权限
+	Audit  AuditSink    //设置后输出握手、认证、解密失败、锁定、踢出等审计事件，可使用 AuditFileWriter
+
+	//连接的数据帧长度限制，见 AesTcpClient.MaxPreAuthFrameSize
+	MaxPreAuthFrameSize uint32
+	MaxFrameSize        uint32
+	MaxJsonSize         uint32
+
+	EnableCrc bool //向客户端提供数据帧CRC32C校验
+
+	EnableCompress    bool //向客户端提供数据压缩
+	CompressThreshold int  //见 AesTcpClient.CompressThreshold
+
+	OnStream     func(tcp *AesTcpClient, pkg *AesPackage, stream *StreamReader) //见 AesTcpClient.OnStream
+	StreamWindow int                                                            //见 AesTcpClient.StreamWindow
+
+	//连接的自动更换会话密钥条件，见 AesTcpClient.RekeyInterval
+	RekeyInterval time.Duration
+	RekeyBytes    uint64
+	RekeyFrames   uint64
 }
 
 func (lsnr *TcpListener) Start(port int) bool {
 	lsnr.Stop()
 
-	lsener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err := lsnr.checkIdentity(); nil != err {
+		fmt.Println("启动监听失败 port=", port, err)
+		return false
+	}
+
+	var lsener net.Listener
+	var err error
+	if nil != lsnr.TLSConfig {
+		lsener, err = tls.Listen("tcp", ":"+strconv.Itoa(port), lsnr.TLSConfig)
+	} else {
+		lsener, err = net.Listen("tcp", ":"+strconv.Itoa(port))
+	}
 	if nil != err {
 		fmt.Println("启动监听失败 port=", port, err)
 		return false
 	}
 
-	lsnr.lsener = &lsener
+	lsnr.lsener.Store(&lsener)
 
-	go lsnr.acceptLoop()
+	go lsnr.acceptLoop(&lsener)
 
 	return true
 }
 
 func (lsnr *TcpListener) Stop() {
-	if nil == lsnr.lsener {
+	lsener := lsnr.lsener.Swap(nil)
+	if nil == lsener {
 		return
 	}
 
-	err := (*lsnr.lsener).Close()
+	err := (*lsener).Close()
 	if nil != err {
-		fmt.Println("停止监听失败 port=", (*lsnr.lsener).Addr(), err)
+		fmt.Println("停止监听失败 port=", (*lsener).Addr(), err)
 	}
-
-	lsnr.lsener = nil
 }
 
-func (lsnr *TcpListener) acceptLoop() {
-	if nil == lsnr.lsener {
-		return
+// Addr 监听地址，未启动时返回nil；Start(0)时用于获取系统分配的端口
+func (lsnr *TcpListener) Addr() net.Addr {
+	lsener := lsnr.lsener.Load()
+	if nil == lsener {
+		return nil
 	}
 
-	for nil != lsnr.lsener {
-		conn, err := (*lsnr.lsener).Accept()
+	return (*lsener).Addr()
+}
+
+func (lsnr *TcpListener) acceptLoop(lsener *net.Listener) {
+	for lsener == lsnr.lsener.Load() {
+		conn, err := (*lsener).Accept()
 		if nil != err {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("接受连接异常", err)
 			continue
 		}
@@ -68,9 +132,13 @@ func (lsnr *TcpListener) acceptLoop() {
 // 封装身份验证操作
 func (tcp *AesTcpClient) Login(host string, port int, username string, pwd string, msTimeOut int) bool {
 	isOk := false
+	tcp.lastErr = nil
+	tcp.resetSession()
+	tcp.beginPreAuth()
 
 	defer func() {
 		if !isOk {
+			tcp.audit(Audit_AuthFailed, username, "", errText(tcp.lastErr))
 			tcp.Close()
 		}
 	}()
@@ -79,50 +147,147 @@ func (tcp *AesTcpClient) Login(host string, port int, username string, pwd strin
 		return false
 	}
 
+	if tlsConn, isTLS := (*tcp.GetConn()).(*tls.Conn); isTLS {
+		err := tcp.tlsHandshake(tlsConn, msTimeOut)
+		if nil != err {
+			tcp.lastErr = err
+			return false
+		}
+	}
+
 	tcp.StartWaitLoop()
 
 	tmDuration := time.Duration(int64(msTimeOut) * int64(time.Millisecond))
 	tmBegin := time.Now()
 
+	var scram *scramClient
+	tokenTried := false
+
 	for time.Since(tmBegin) < tmDuration {
 		pac := tcp.readAesPackage(msTimeOut)
 		if nil == pac {
 			return false
 		}
 
-		fmt.Println(tcp.ClientFlag, "接收到数据 PacSN=", pac.PacSN, " Cmd=", pac.Cmd, " Json=", string(pac.Json), " data=", pac.ExtData)
-		// client.SendJson()
-
 		switch pac.Cmd {
 		case Cmd_GetUserNamePwd:
 			{
+				req := AesCmd{}
+				json.Unmarshal([]byte(pac.Json), &req)
+
+				//确认密钥交换的握手记录未被修改
+				if err := tcp.checkFinish(req.Ext); nil != err {
+					tcp.lastErr = err
+					return false
+				}
+
 				ans := AesCmd{}
 				ans.IsOK = true
 				ans.Msg = ""
-				ans.Data = struct {
-					Name string `json:"name"`
-					Pwd  string `json:"pwd"`
-				}{
-					Name: username,
-					Pwd:  pwd}
 
-				tcp.SendJson(0x8000|pac.PacSN, pac.Cmd, ans.ToJson(), nil)
+				if tokenTried {
+					//令牌未被接受，服务端再次请求认证
+					tcp.SessionToken = ""
+				}
+
+				if len(tcp.SessionToken) > 0 && !tokenTried && req.Ext.hasAuth(authNameToken) {
+					//出示会话令牌，跳过口令步骤
+					tokenTried = true
+					ans.Data = struct {
+						Name  string `json:"name"`
+						Token string `json:"token"`
+					}{
+						Name:  username,
+						Token: tcp.SessionToken}
+					ans.Ext = &HandshakeExt{Auth: authNameToken}
+				} else if nil != tcp.DeviceKey && req.Ext.hasAuth(authNameDevice) {
+					//设备私钥签名服务端挑战，不需要口令
+					ans.Data = struct {
+						Name string `json:"name"`
+						Sig  string `json:"sig"`
+					}{
+						Name: username,
+						Sig:  hex.EncodeToString(tcp.DeviceKey.Sign(deviceSignData(username, req.Ext.getNonce(), tcp.cbind)))}
+					ans.Ext = &HandshakeExt{Auth: authNameDevice}
+				} else if req.Ext.hasAuth(authNameScram) {
+					//服务端支持SCRAM时不发送口令
+					scram = newScramClient(username, pwd)
+					ans.Data = scram.first()
+					ans.Ext = &HandshakeExt{Auth: authNameScram}
+				} else {
+					ans.Data = struct {
+						Name string `json:"name"`
+						Pwd  string `json:"pwd"`
+					}{
+						Name: username,
+						Pwd:  pwd}
+				}
+
+				//服务端可能在认证结果之后立即发送业务数据，提交认证信息前恢复正常的数据帧长度限制
+				tcp.endPreAuth()
+
+				if nil != req.Ext && req.Ext.Ver > 0 {
+					//TLS连接没有密钥交换，在此协商协议版本和功能
+					if nil == ans.Ext {
+						ans.Ext = &HandshakeExt{}
+					}
+					tcp.agreeProtocol(&tcp.codec, req.Ext, ans.Ext)
+				}
+
+				tcp.ReplyJson(pac, pac.Cmd, ans.ToJson(), nil)
+			}
+		case Cmd_ScramChallenge:
+			{
+				if nil == scram {
+					continue
+				}
+
+				var req struct {
+					Data scramChallenge `json:"data"`
+				}
+				ans := AesCmd{}
+				err := json.Unmarshal([]byte(pac.Json), &req)
+				if nil == err {
+					ans.Data, err = scram.final(&req.Data, tcp.cbind)
+				}
+				if nil != err {
+					ans.Msg = err.Error()
+				} else {
+					ans.IsOK = true
+				}
+
+				tcp.ReplyJson(pac, pac.Cmd, ans.ToJson(), nil)
 			}
 		case Cmd_AuthorizeResult:
 			{
-				cmd := AesCmd{}
+				var cmd struct {
+					AesCmd
+					Data struct {
+						ServerSig []byte `json:"serversig"`
+						Token     string `json:"token"`
+					} `json:"data"`
+				}
 				err := json.Unmarshal([]byte(pac.Json), &cmd)
 				if nil != err {
-					fmt.Println("Json 转 Cmd 失败", err)
 					continue
 				}
 
 				if cmd.IsOK {
+					//SCRAM认证需校验服务端签名，确认服务端持有验证数据
+					if nil != scram && !scram.verifyServer(cmd.Data.ServerSig) {
+						tcp.lastErr = ErrServerProofMismatch
+						return false
+					}
+
+					if len(cmd.Data.Token) > 0 {
+						tcp.SessionToken = cmd.Data.Token
+					}
+
 					isOk = true
-					fmt.Println("身份认证成功")
+					tcp.audit(Audit_AuthOK, username, "", "")
 					return isOk
 				} else {
-					fmt.Println("身份认证失败:", cmd.Msg)
+					tcp.lastErr = NewAuthError(AuthReason(cmd.Reason), cmd.Msg)
 				}
 				break
 			}
@@ -135,66 +300,146 @@ func (tcp *AesTcpClient) Login(host string, port int, username string, pwd strin
 func AuthorizeConn(lsn *TcpListener, conn *net.Conn) *AesTcpClient {
 	var name, password string
 
-	ecc := &ECC{}
-	ecc.initKey()
+	//被锁定的来源IP直接断开，不做密钥交换
+	ip := RemoteIP(*conn)
+	if nil != lsn && nil != lsn.Guard {
+		if err := lsn.Guard.CheckIP(ip); nil != err {
+			if nil != lsn.Audit {
+				lsn.Audit.WriteEvent(&AuditEvent{Time: time.Now(), Type: Audit_ConnRejected, RemoteAddr: (*conn).RemoteAddr().String(), Reason: string(AuthReason_Locked)})
+			}
+			(*conn).Close()
+			return nil
+		}
+	}
 
 	ptc := NewAesTcpClientWithConn(conn)
 	ptc.ClientFlag = "Server"
-	fmt.Println(ptc.ClientFlag, "Received client:", (*conn).RemoteAddr())
-	ptc.StartWaitLoop()
-
-	cmd := AesCmd{IsOK: true}
-	cmd.Data = ecc.EccKey.PublicKey.Hex(true)
-	jdata, _ := json.Marshal(cmd)
-	pkg := ptc.SendJsonAndWait(ptc.GetNexPacSN(), Cmd_GetAesKey, string(jdata), nil, 3000)
-	if nil == pkg {
-		fmt.Println(ptc.ClientFlag, "Failed to request Aes key")
-		ptc.Close()
-		return nil
+	ptc.isServer = true
+	ptc.remoteAddr = (*conn).RemoteAddr().String()
+	if nil != lsn {
+		ptc.EnableGcm = lsn.EnableGcm
+		ptc.EnableEcdh = lsn.EnableEcdh
+		ptc.CipherSuites = lsn.CipherSuites
+		ptc.RequireAead = lsn.RequireAead
+		ptc.policy = lsn.Policy
+		ptc.RekeyInterval = lsn.RekeyInterval
+		ptc.RekeyBytes = lsn.RekeyBytes
+		ptc.RekeyFrames = lsn.RekeyFrames
+		ptc.Audit = lsn.Audit
+		ptc.MaxFrameSize = lsn.MaxFrameSize
+		ptc.MaxPreAuthFrameSize = lsn.MaxPreAuthFrameSize
+		ptc.MaxJsonSize = lsn.MaxJsonSize
+		ptc.EnableCrc = lsn.EnableCrc
+		ptc.EnableCompress = lsn.EnableCompress
+		ptc.CompressThreshold = lsn.CompressThreshold
+		ptc.OnStream = lsn.OnStream
+		ptc.StreamWindow = lsn.StreamWindow
 	}
+	ptc.beginPreAuth()
+	ptc.audit(Audit_ConnAccepted, "", "", "")
 
-	fmt.Println(ptc.ClientFlag, "Received:", pkg.Json)
-	var cmdRslt AesCmd
-	err := json.Unmarshal([]byte(pkg.Json), &cmdRslt)
-	if nil != err {
-		fmt.Println(ptc.ClientFlag, "Failed to convert package to command", err)
-		ptc.Close()
-		return nil
+	//TLS连接由TLS保护数据，跳过ECC/AES密钥交换
+	tlsConn, isTLS := (*conn).(*tls.Conn)
+	if isTLS {
+		err := ptc.tlsHandshake(tlsConn, 3000)
+		if nil != err {
+			ptc.audit(Audit_KexFailed, "", err.Error(), "tls")
+			ptc.Close()
+			return nil
+		}
 	}
 
-	data, err := hex.DecodeString(cmdRslt.Data.(string))
-	if nil != err {
-		fmt.Println(ptc.ClientFlag, "Failed to convert hex key data to []byte", err)
-		ptc.Close()
-		return nil
+	ptc.StartWaitLoop()
+
+	//配置了预共享密钥时先提供PSK握手，客户端拒绝时（没有密钥）改用ECC密钥交换
+	if !isTLS {
+		var exchanged bool
+		kex := "ecc"
+		if nil != lsn && nil != lsn.OnGetPsk {
+			kex = "psk"
+			exchanged = ptc.serverPskExchange(lsn)
+			if !exchanged && ptc.lastErr == ErrPskDeclined && !lsn.RequirePsk {
+				kex = "ecc"
+				ptc.lastErr = nil
+				exchanged = ptc.serverKeyExchange(lsn)
+			}
+		} else {
+			exchanged = ptc.serverKeyExchange(lsn)
+		}
+		if !exchanged {
+			ptc.audit(Audit_KexFailed, "", errText(ptc.lastErr), kex)
+			ptc.Close()
+			return nil
+		}
 	}
+	ptc.audit(Audit_KexOK, "", "", ptc.GetCipherSuite())
+
+	cmd := AesCmd{IsOK: true}
+	var jdata []byte
+	var pkg *AesPackage
+	var cmdRslt AesCmd
+	var err error
 
-	key := ecc.Decrypt(data)
-	ptc.aesKey = key
+	var authMethod, deviceKey string
+	var user *LoginUserInfo
+	var attempt *loginAttempt
+	locked := false
+	defer func() { attempt.cancel() }()
 
 	rslt := AesCmd{IsOK: false}
-	for idx := 0; idx < 1; idx++ {
+	for idx := 0; idx < 2; idx++ {
 		//请求用户名密码
 		cmd.Data = time.Now().Unix()
+		if nil != lsn && nil != lsn.OnGetVerifier {
+			cmd.Ext = &HandshakeExt{Auths: []string{authNameScram}}
+		}
+		if nil != lsn && nil != lsn.Tokens && 0 == idx {
+			//令牌无效时再次请求时不再提供令牌认证
+			if nil == cmd.Ext {
+				cmd.Ext = &HandshakeExt{}
+			}
+			cmd.Ext.Auths = append(cmd.Ext.Auths, authNameToken)
+		}
+		if nil != lsn && nil != lsn.OnGetDeviceKey {
+			if nil == cmd.Ext {
+				cmd.Ext = &HandshakeExt{}
+			}
+			cmd.Ext.Auths = append(cmd.Ext.Auths, authNameDevice)
+			cmd.Ext.Nonce = scramNonce()
+		}
+		if isTLS && 0 == idx {
+			if nil == cmd.Ext {
+				cmd.Ext = &HandshakeExt{}
+			}
+			ptc.offerProtocol(cmd.Ext)
+		}
+		if nil != ptc.kexTranscript {
+			if nil == cmd.Ext {
+				cmd.Ext = &HandshakeExt{}
+			}
+			cmd.Ext.Finish = hex.EncodeToString(handshakeFinishMac(ptc.cbind, ptc.kexTranscript))
+		}
+		nonce := cmd.Ext.getNonce()
 		jdata, _ = json.Marshal(cmd)
-		pkg = ptc.SendJsonAndWait(ptc.GetNexPacSN(), Cmd_GetUserNamePwd, string(jdata), nil, 3000)
-		if nil == pkg {
-			fmt.Println(ptc.ClientFlag, "Failed to request name and password")
-			ptc.Close()
-			return nil
+		cmd.Ext = nil
+		pkg, err = ptc.SendJsonAndWaitErr(ptc.GetNexPacSN(), Cmd_GetUserNamePwd, string(jdata), nil, 3000)
+		if nil == err {
+			cmdRslt = AesCmd{}
+			err = json.Unmarshal([]byte(pkg.Json), &cmdRslt)
 		}
-
-		fmt.Println(ptc.ClientFlag, "Received: ", pkg.Json)
-		err = json.Unmarshal([]byte(pkg.Json), &cmdRslt)
 		if nil != err {
-			fmt.Println("Failed to convert package to command", err)
+			ptc.audit(Audit_AuthFailed, name, string(AuthReason_BadRequest), err.Error())
 			ptc.Close()
 			return nil
 		}
+		if isTLS && 0 == idx {
+			ptc.applyProtocol(cmdRslt.Ext)
+		}
 
 		if nil == cmdRslt.Data {
 			rslt.IsOK = false
 			rslt.Msg = "Empty data field"
+			rslt.Reason = string(AuthReason_BadRequest)
 			break
 		}
 
@@ -202,49 +447,359 @@ func AuthorizeConn(lsn *TcpListener, conn *net.Conn) *AesTcpClient {
 		if !ok {
 			rslt.IsOK = false
 			rslt.Msg = "Data field is not an object"
+			rslt.Reason = string(AuthReason_BadRequest)
 			break
 		}
 		obj, has := dic["name"]
 		if !has {
 			rslt.IsOK = false
 			rslt.Msg = "No name field"
+			rslt.Reason = string(AuthReason_BadRequest)
 			break
 		}
-		if nil == obj || len(obj.(string)) <= 0 {
+		name, _ = obj.(string)
+		if len(name) <= 0 {
 			rslt.IsOK = false
 			rslt.Msg = "Empty name"
+			rslt.Reason = string(AuthReason_BadRequest)
 			break
 		}
-		name = obj.(string)
+
+		//校验凭据前登记本次尝试，同时重新检查来源IP和用户名是否已被其他连接的失败锁定
+		if nil != lsn && nil != lsn.Guard {
+			attempt.cancel()
+			attempt, err = lsn.Guard.begin(ip, name)
+			if nil != err {
+				locked = true
+				rslt.IsOK = false
+				rslt.Msg = ErrLoginLocked.Error()
+				rslt.Reason = string(AuthReason_Locked)
+				break
+			}
+		}
+
+		//会话令牌认证，令牌无效时改用其他方式重新认证
+		if 0 == idx && nil != cmdRslt.Ext && cmdRslt.Ext.Auth == authNameToken && nil != lsn && nil != lsn.Tokens {
+			token, _ := dic["token"].(string)
+			claims, err := lsn.Tokens.verify(token)
+			if nil != err || claims.Name != name {
+				ptc.audit(Audit_AuthFailed, name, string(AuthReason_BadCredentials), authNameToken)
+				rslt.Msg = "Session token is not accepted"
+				rslt.Reason = string(AuthReason_BadCredentials)
+				continue
+			}
+
+			//设备令牌要求设备公钥仍然登记有效，吊销设备后其令牌随之失效
+			if len(claims.DeviceKey) > 0 && !deviceKeyValid(lsn, name, claims.DeviceKey) {
+				ptc.audit(Audit_AuthFailed, name, string(AuthReason_BadCredentials), authNameToken)
+				rslt.Msg = "Session token is not accepted"
+				rslt.Reason = string(AuthReason_BadCredentials)
+				continue
+			}
+
+			authMethod = authNameToken
+			deviceKey = claims.DeviceKey
+			rslt.IsOK = true
+			break
+		}
+
+		//设备公钥认证
+		if nil != cmdRslt.Ext && cmdRslt.Ext.Auth == authNameDevice && len(nonce) > 0 {
+			sig, _ := dic["sig"].(string)
+			deviceKey, ok = ptc.deviceAuthorize(lsn, name, nonce, sig)
+			if !ok {
+				rslt.IsOK = false
+				rslt.Msg = "Device key is not accepted"
+				rslt.Reason = string(AuthReason_BadCredentials)
+				break
+			}
+
+			authMethod = authNameDevice
+			rslt.IsOK = true
+			break
+		}
+
+		//SCRAM认证，口令不经过网络
+		if nil != cmdRslt.Ext && cmdRslt.Ext.Auth == authNameScram && nil != lsn && nil != lsn.OnGetVerifier {
+			cnonce, _ := dic["cnonce"].(string)
+			if len(cnonce) <= 0 {
+				rslt.IsOK = false
+				rslt.Msg = "Empty client nonce"
+				rslt.Reason = string(AuthReason_BadRequest)
+				break
+			}
+
+			serverSig, ok := ptc.scramAuthorize(lsn.OnGetVerifier(name), &scramFirst{Name: name, CNonce: cnonce})
+			if !ok {
+				rslt.IsOK = false
+				rslt.Msg = "name or password is not correct"
+				rslt.Reason = string(AuthReason_BadCredentials)
+				break
+			}
+
+			rslt.Data = map[string]any{"serversig": serverSig}
+			authMethod = authNameScram
+			rslt.IsOK = true
+			break
+		}
+
 		obj, has = dic["pwd"]
 		if !has {
 			rslt.IsOK = false
 			rslt.Msg = "No password field"
+			rslt.Reason = string(AuthReason_BadRequest)
+			break
+		}
+		password, _ = obj.(string)
+
+		if nil != lsn && lsn.RequireScram {
+			rslt.IsOK = false
+			rslt.Msg = "Password login is disabled, scram is required"
+			rslt.Reason = string(AuthReason_MethodNotAllowed)
 			break
 		}
-		password = obj.(string)
 
 		//Check UserName and Password here
-		if nil == lsn || nil == lsn.OnAuthorize || !lsn.OnAuthorize(name, password) {
+		if nil != lsn && nil != lsn.Authenticator {
+			user, err = lsn.authenticate(&Credentials{Method: authNamePassword, Name: name, Password: password, RemoteAddr: ip})
+			if nil != err || nil == user {
+				setAuthReject(&rslt, err)
+				break
+			}
+			ok = true
+		} else if nil != lsn && nil != lsn.OnAuthorize {
+			ok = lsn.OnAuthorize(name, password)
+		} else if nil != lsn && nil != lsn.OnGetVerifier {
+			v := lsn.OnGetVerifier(name)
+			ok = nil != v && v.VerifyPassword(password)
+		} else {
+			ok = false
+		}
+		if !ok {
 			rslt.IsOK = false
 			rslt.Msg = "name or password is not correct"
+			rslt.Reason = string(AuthReason_BadCredentials)
 			break
 		}
 
+		authMethod = authNamePassword
 		rslt.IsOK = true
+		break
+	}
+
+	//协议已校验的认证方式，由Authenticator查找用户身份
+	if rslt.IsOK && nil == user && nil != lsn && nil != lsn.Authenticator {
+		user, err = lsn.authenticate(&Credentials{Method: authMethod, Name: name, DeviceKey: deviceKey, RemoteAddr: ip})
+		if nil != err || nil == user {
+			setAuthReject(&rslt, err)
+		}
 	}
 
-	//发送认证结果
+	if rslt.IsOK {
+		if nil == user {
+			user = &LoginUserInfo{ID: 0}
+		}
+		if len(user.Name) <= 0 {
+			user.Name = name
+		}
+		user.AuthMethod = authMethod
+		user.DeviceKey = deviceKey
+		ptc.User = user
+
+		//签发会话令牌，令牌登录时不再续签
+		if nil != lsn && nil != lsn.Tokens && authMethod != authNameToken {
+			data, _ := rslt.Data.(map[string]any)
+			if nil == data {
+				data = make(map[string]any)
+			}
+			data["token"] = lsn.Tokens.issue(ptc.User)
+			rslt.Data = data
+		}
+	}
+
+	//失败计数，延迟回复降低猜测速度
+	if nil != lsn && nil != lsn.Guard {
+		if rslt.IsOK {
+			attempt.succeed()
+		} else if !locked {
+			var delay time.Duration
+			var events []lockEvent
+			if nil != attempt {
+				delay, events = attempt.fail(rslt.Reason != string(AuthReason_UnknownUser))
+			} else {
+				delay, events = lsn.Guard.fail(ip, name)
+			}
+			for _, ev := range events {
+				ptc.audit(Audit_Lockout, name, string(AuthReason_Locked), ev.kind)
+			}
+			time.Sleep(delay)
+		}
+	}
+
+	//发送认证结果，认证成功后客户端可能立即发送较大的数据帧
+	if rslt.IsOK {
+		ptc.endPreAuth()
+	}
 	jdata, _ = json.Marshal(rslt)
 	ptc.SendJson(ptc.GetNexPacSN(), Cmd_AuthorizeResult, string(jdata), nil)
 
 	if rslt.IsOK {
-		ptc.User = &LoginUserInfo{ID: 0, Name: name}
-		fmt.Println(ptc.ClientFlag, "Authorize OK")
+		ptc.audit(Audit_AuthOK, "", "", authMethod)
 		return ptc
 	} else {
-		fmt.Println(ptc.ClientFlag, "Failed to authorize:", rslt.Msg)
+		ptc.audit(Audit_AuthFailed, name, rslt.Reason, rslt.Msg)
 		ptc.Close()
 		return nil
 	}
 }
+
+// setAuthReject 认证被拒绝，设置结果的原因和说明
+func setAuthReject(rslt *AesCmd, err error) {
+	authErr := NewAuthError(AuthReason_BadCredentials, "name or password is not correct")
+	if nil != err {
+		authErr = toAuthError(err)
+	}
+
+	rslt.IsOK = false
+	rslt.Data = nil
+	rslt.Reason = string(authErr.Reason)
+	rslt.Msg = authErr.Msg
+}
+
+// serverOffer 服务端提供的加密模式和扩展功能
+func (ptc *AesTcpClient) serverOffer() *HandshakeExt {
+	ext := &HandshakeExt{ExtEnc: true, Seq: true, Rekey: true, Nego: true}
+	if ptc.EnableGcm {
+		ext.Ciphers = []string{cipherNameAesGcm}
+	}
+	ptc.offerProtocol(ext)
+
+	return ext
+}
+
+// checkIdentity 身份密钥必须在启动前加载（如 LoadOrCreateECC），不在连接中临时生成：
+// 各连接并发使用同一个密钥，临时生成既有数据竞争，每次启动也会变成新身份
+func (lsn *TcpListener) checkIdentity() error {
+	if nil != lsn.Identity && nil == lsn.Identity.EccKey {
+		return ErrBadEccKey
+	}
+	if nil != lsn.IdentityKeys {
+		cur := lsn.IdentityKeys.Current()
+		if nil == cur || nil == cur.EccKey {
+			return ErrBadEccKey
+		}
+	}
+
+	return nil
+}
+
+// identityKeys 用于签名临时公钥的身份密钥，当前密钥在前
+func (lsn *TcpListener) identityKeys() []*ECC {
+	if nil != lsn.IdentityKeys {
+		return lsn.IdentityKeys.Keys()
+	}
+	if nil != lsn.Identity {
+		return []*ECC{lsn.Identity}
+	}
+
+	return nil
+}
+
+// applyChoice 按客户端的选择设置帧编码参数
+func (ptc *AesTcpClient) applyChoice(choice *HandshakeExt) {
+	ptc.applyProtocol(choice)
+	if nil == choice {
+		return
+	}
+
+	if ptc.EnableGcm && choice.Cipher == cipherNameAesGcm {
+		ptc.codec.mode = Cipher_AesGcm
+	}
+	ptc.codec.extEnc = choice.ExtEnc
+	ptc.codec.seq = choice.Seq
+	ptc.codec.rekey = choice.Rekey
+}
+
+// serverKeyExchange 服务端ECC密钥交换，协商加密参数并设置会话密钥
+func (ptc *AesTcpClient) serverKeyExchange(lsn *TcpListener) bool {
+	ecc := &ECC{}
+	ecc.initKey()
+
+	pubKey := ecc.EccKey.PublicKey.Hex(true)
+	cmd := AesCmd{IsOK: true, Data: pubKey}
+	cmd.Ext = ptc.serverOffer()
+	if ptc.EnableEcdh {
+		cmd.Ext.Kexs = []string{kexNameEcdh}
+	}
+	if nil != lsn {
+		signData := serverKeySignData(pubKey, cmd.Ext)
+		for idx, key := range lsn.identityKeys() {
+			proof := idProof{Key: key.GetPubKey().Hex(true), Sign: hex.EncodeToString(key.Sign(signData))}
+			if 0 == idx {
+				cmd.Ext.IdKey, cmd.Ext.IdSign = proof.Key, proof.Sign
+			} else {
+				cmd.Ext.IdAlts = append(cmd.Ext.IdAlts, proof)
+			}
+		}
+	}
+	jdata, _ := json.Marshal(cmd)
+	pkg, err := ptc.SendJsonAndWaitErr(ptc.GetNexPacSN(), Cmd_GetAesKey, string(jdata), nil, 3000)
+	if nil != err {
+		ptc.lastErr = err
+		return false
+	}
+
+	var cmdRslt AesCmd
+	err = json.Unmarshal([]byte(pkg.Json), &cmdRslt)
+	if nil != err || !cmdRslt.IsOK {
+		ptc.lastErr = ErrKexRefused
+		return false
+	}
+
+	keyHex, _ := cmdRslt.Data.(string)
+	ptc.applyChoice(cmdRslt.Ext)
+	ptc.kexTranscript = transcriptHash(string(jdata), pkg.Json)
+
+	if ptc.EnableEcdh && nil != cmdRslt.Ext && cmdRslt.Ext.Kex == kexNameEcdh {
+		//ECDH：Data为客户端临时公钥
+		pubKey, err := ecies.NewPublicKeyFromHex(keyHex)
+		var secret []byte
+		if nil == err {
+			secret, err = ecc.EccKey.ECDH(pubKey)
+		}
+		if nil != err {
+			ptc.lastErr = err
+			return false
+		}
+		if nil != cmdRslt.Ext && len(cmdRslt.Ext.Suites) > 0 {
+			return ptc.negotiateSuite(secret, string(jdata), pkg.Json, cmdRslt.Ext.Suites)
+		}
+		if !ptc.legacySuiteAllowed(ptc.codec) {
+			ptc.lastErr = ErrNoCipherSuite
+			return false
+		}
+		ptc.setDerivedKeys(secret, transcriptHash(string(jdata), pkg.Json), 16)
+	} else {
+		data, err := hex.DecodeString(keyHex)
+		if nil != err {
+			ptc.lastErr = err
+			return false
+		}
+
+		key := ecc.Decrypt(data)
+		if nil == key {
+			ptc.lastErr = ErrBadFrame
+			return false
+		}
+		if nil != cmdRslt.Ext && len(cmdRslt.Ext.Suites) > 0 {
+			return ptc.negotiateSuite(key, string(jdata), pkg.Json, cmdRslt.Ext.Suites)
+		}
+		if !ptc.legacySuiteAllowed(ptc.codec) {
+			ptc.lastErr = ErrNoCipherSuite
+			return false
+		}
+		ptc.setEciesKey(key)
+	}
+
+	return true
+}
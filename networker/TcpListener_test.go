@@ -0,0 +1,100 @@
+package networker
+
+import (
+	"net"
+	"testing"
+)
+
+// testEchoHandler 回显收到的请求
+func testEchoHandler(tcp *AesTcpClient, pkg *AesPackage) {
+	tcp.ReplyJson(pkg, pkg.Cmd, "echo:"+pkg.Json, pkg.ExtData)
+}
+
+// testListener 在本机随机端口启动监听，认证通过的连接回显收到的请求；
+// 返回端口和服务端连接（认证失败时为nil）
+func testListener(t *testing.T, cfg func(lsnr *TcpListener)) (int, chan *AesTcpClient) {
+	return testListenerHandler(t, cfg, testEchoHandler)
+}
+
+// testListenerHandler 同 testListener，handler为nil时服务端连接不设置回调，由测试用 ReadAesPackage 读取
+func testListenerHandler(t *testing.T, cfg func(lsnr *TcpListener), handler func(tcp *AesTcpClient, pkg *AesPackage)) (int, chan *AesTcpClient) {
+	ch := make(chan *AesTcpClient, 4)
+	lsnr := &TcpListener{}
+	lsnr.OnAuthorize = func(name string, pwd string) bool {
+		return name == "admin" && pwd == "admin"
+	}
+	if nil != cfg {
+		cfg(lsnr)
+	}
+	lsnr.OnClientAccepted = func(conn *net.Conn) {
+		go func() {
+			tcp := AuthorizeConn(lsnr, conn)
+			if nil != tcp {
+				if nil != handler {
+					tcp.SetAesPackageHandler(handler)
+				}
+				t.Cleanup(tcp.Close)
+			}
+			ch <- tcp
+		}()
+	}
+
+	if !lsnr.Start(0) {
+		t.Fatal("启动监听失败")
+	}
+	t.Cleanup(lsnr.Stop)
+
+	return lsnr.Addr().(*net.TCPAddr).Port, ch
+}
+
+// testLogin 登录测试服务端，失败时结束测试
+func testLogin(t *testing.T, cli *AesTcpClient, port int) {
+	if !cli.Login("127.0.0.1", port, "admin", "admin", 3000) {
+		t.Fatal("登录失败", cli.GetLastError())
+	}
+	t.Cleanup(cli.Close)
+}
+
+// testEcho 发送请求并检查回显的JSON和扩展数据
+func testEcho(t *testing.T, cli *AesTcpClient, n int) {
+	ext := testExtData(n)
+	ans, err := cli.SendJsonAndWaitErr(cli.GetNexPacSN(), Cmd_Test, "hello", ext, 3000)
+	if nil != err {
+		t.Fatal("请求失败", err)
+	}
+	if ans.Json != "echo:hello" || string(ans.ExtData) != string(ext) {
+		t.Fatal("回显错误", ans.Json, len(ans.ExtData))
+	}
+}
+
+func TestLoginEcho(t *testing.T) {
+	port, ch := testListener(t, nil)
+
+	cli := NewAesTcpClient()
+	testLogin(t, cli, port)
+	svr := <-ch
+	if nil == svr {
+		t.Fatal("服务端认证失败")
+	}
+	if nil == svr.User || svr.User.Name != "admin" || svr.User.AuthMethod != "password" {
+		t.Fatal("服务端用户信息错误", svr.User)
+	}
+	if svr.GetCipherMode() != cli.GetCipherMode() {
+		t.Fatal("双方加密方式不一致", svr.GetCipherMode(), cli.GetCipherMode())
+	}
+
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	for _, n := range []int{0, 100, 200000} {
+		testEcho(t, cli, n)
+	}
+
+	//口令错误
+	bad := NewAesTcpClient()
+	if bad.Login("127.0.0.1", port, "admin", "wrong", 3000) {
+		t.Fatal("错误口令登录成功")
+	}
+	if nil != <-ch {
+		t.Fatal("错误口令通过服务端认证")
+	}
+	bad.Close()
+}
@@ -0,0 +1,33 @@
+package networker
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+)
+
+// TLS传输：TcpListener.TLSConfig 或 AesTcpClient.TLSConfig 设置后连接使用 crypto/tls，
+// 不再进行ECC密钥交换，数据帧不再AES加密，帧格式、SendJsonAndWait和用户名口令认证步骤不变；
+// SCRAM和设备认证的会话绑定值取自TLS导出密钥，服务端身份由TLS证书校验
+
+const tlsExporterLabel = "EXPORTER-networker-binding"
+
+// tlsHandshake 完成TLS握手并设置会话绑定值
+func (tcp *AesTcpClient) tlsHandshake(conn *tls.Conn, msTimeOut int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(msTimeOut)*time.Millisecond)
+	defer cancel()
+
+	err := conn.HandshakeContext(ctx)
+	if nil != err {
+		return err
+	}
+
+	state := conn.ConnectionState()
+	cbind, err := state.ExportKeyingMaterial(tlsExporterLabel, nil, 32)
+	if nil != err {
+		return err
+	}
+
+	tcp.cbind = cbind
+	return nil
+}
@@ -0,0 +1,105 @@
+package networker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert 生成自签名证书，返回证书和只信任该证书的证书池
+func testCert(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTlsLogin(t *testing.T) {
+	svrCert, svrPool := testCert(t, "server")
+	devCert, devPool := testCert(t, "dev")
+	store := NewVerifierStore()
+	store.SetPassword("admin", "admin")
+	port, ch := testListener(t, func(lsnr *TcpListener) {
+		lsnr.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{svrCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    devPool,
+		}
+		lsnr.OnGetVerifier = store.Get
+	})
+
+	//双向认证，SCRAM绑定TLS会话
+	cli := NewAesTcpClient()
+	cli.TLSConfig = &tls.Config{RootCAs: svrPool, ServerName: "localhost", Certificates: []tls.Certificate{devCert}}
+	testLogin(t, cli, port)
+	svr := <-ch
+	if nil == svr || svr.User.AuthMethod != authNameScram {
+		t.Fatal("服务端认证失败")
+	}
+	state, isTLS := svr.GetTLSState()
+	if !isTLS || len(state.PeerCertificates) <= 0 || state.PeerCertificates[0].Subject.CommonName != "dev" {
+		t.Fatal("服务端没有取得客户端证书")
+	}
+	svr.keyLock.RLock()
+	aesKey := svr.aesKey
+	svr.keyLock.RUnlock()
+	if nil != aesKey {
+		t.Fatal("TLS连接不应再协商AES密钥")
+	}
+
+	cli.SetAesPackageHandler(func(tcp *AesTcpClient, pkg *AesPackage) {})
+	for _, n := range []int{0, 200000} {
+		testEcho(t, cli, n)
+	}
+
+	//没有客户端证书
+	noCert := NewAesTcpClient()
+	noCert.TLSConfig = &tls.Config{RootCAs: svrPool, ServerName: "localhost"}
+	if noCert.Login("127.0.0.1", port, "admin", "admin", 1000) {
+		t.Fatal("没有客户端证书登录成功")
+	}
+	if nil != <-ch {
+		t.Fatal("服务端接受了没有证书的客户端")
+	}
+	noCert.Close()
+
+	//不信任服务端证书
+	untrusted := NewAesTcpClient()
+	untrusted.TLSConfig = &tls.Config{RootCAs: devPool, ServerName: "localhost", Certificates: []tls.Certificate{devCert}}
+	if untrusted.Login("127.0.0.1", port, "admin", "admin", 1000) {
+		t.Fatal("不信任的服务端证书登录成功")
+	}
+	<-ch
+	untrusted.Close()
+}
@@ -0,0 +1,596 @@
+package networker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	ecies "github.com/ecies/go/v2"
+)
+
+// UDP安全模式：对端之间先握手建立会话密钥，之后每个数据报用AES-256-GCM加密并认证
+// 握手方式：
+//   ECDH：双方各发送临时公钥、身份公钥和身份私钥对握手内容的签名，对端按 KnownPeers 校验身份，
+//         双方由共享密钥和握手记录经HKDF派生两个方向的密钥；未设置身份密钥时不进行ECDH握手
+//         发起方按目标地址首次信任响应方；响应方只接受 KnownPeers 中已登记的身份指纹，
+//         不按来源地址首次信任，伪造来源地址的握手请求不会写入记录
+//   PSK ：发起方发送密钥ID、随机数和密钥确认码，响应方校验后回复随机数和确认码，由预共享密钥派生会话密钥
+// 数据报格式：1字节类型 + 8字节序号 + 密文(含16字节tag)，nonce由序号构成，附加数据为类型和序号
+// 无法解密、认证失败、重放以及非安全模式的数据报在 OnDataReceived 之前丢弃
+// 已有会话时对端的重新握手只登记待启用密钥，收到用新密钥加密的数据报后才启用，
+// 重放或伪造的握手请求不影响已有会话；每组密钥有各自的防重放窗口
+// 握手数据报由单独的协程处理（签名、ECDH、保存记录），不阻塞数据报接收，处理不及时的握手请求被丢弃
+
+var (
+	ErrUdpHandshakeTimeout = errors.New("udp secure handshake timeout")
+	ErrUdpNoSession        = errors.New("udp secure session not established")
+	ErrUdpNoIdentity       = errors.New("udp ecdh handshake requires Identity and KnownPeers")
+	ErrUdpPeerUnknown      = errors.New("udp peer identity is not registered")
+	ErrUdpBusy             = errors.New("udp handshake queue is full")
+)
+
+const (
+	udpType_Hello    = 0x01
+	udpType_HelloAck = 0x02
+	udpType_Data     = 0x03
+
+	udpKex_Ecdh = 'E'
+	udpKex_Psk  = 'P'
+
+	udpNonceSize  = 16
+	udpMacSize    = sha256.Size
+	udpSeqSize    = 8
+	udpPubKeySize = 33 //压缩格式公钥
+
+	udpMaxSessions    = 4096
+	udpHandshakeQueue = 64 //等待处理的握手数据报上限
+)
+
+// udpDatagram 等待握手协程处理的数据报
+type udpDatagram struct {
+	data  []byte
+	raddr *net.UDPAddr
+}
+
+// udpKeys 一次握手得到的密钥及其防重放窗口
+type udpKeys struct {
+	keys   sessionKeys
+	window replayWindow
+}
+
+// udpSession 与一个对端地址的安全会话
+type udpSession struct {
+	lock     sync.Mutex
+	cur      *udpKeys //使用中的密钥，为nil时会话尚未建立
+	prev     *udpKeys //更换前的密钥，接收对端更换前发出的数据报
+	pending  *udpKeys //对端重新握手得到的密钥，收到用它加密的数据报后启用
+	sendSeq  uint64
+	lastSeen time.Time
+}
+
+// udpHandshake 发起方等待响应的握手
+type udpHandshake struct {
+	kex   byte
+	hello []byte
+	ecc   *ECC
+	psk   []byte
+	done  chan *udpKeys
+}
+
+func udpPskHelloMac(psk []byte, keyID string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, hkdfExpand(psk, nil, "networker udp psk confirm", sha256.Size))
+	mac.Write(transcriptHash("udp hello", keyID, string(nonce)))
+	return mac.Sum(nil)
+}
+
+func udpFinishedMac(psk []byte, transcript []byte) []byte {
+	return hkdfExpand(psk, transcript, "networker udp finished", udpMacSize)
+}
+
+func newUdpKeys(secret []byte, transcript []byte, isResponder bool) *udpKeys {
+	return &udpKeys{keys: deriveSessionKeys(secret, transcript, 32, isResponder)}
+}
+
+// udpHelloSignData 发起方身份签名的内容
+func udpHelloSignData(ephemeral []byte) []byte {
+	return transcriptHash("udp ecdh hello", string(ephemeral))
+}
+
+// udpAckSignData 响应方身份签名的内容，绑定发起方的握手请求
+func udpAckSignData(hello []byte, ephemeral []byte) []byte {
+	return transcriptHash("udp ecdh ack", string(hello), string(ephemeral))
+}
+
+// udpIdentityPart ECDH握手中的临时公钥 + 身份公钥 + 身份签名
+func udpIdentityPart(ecc *ECC, identity *ECC, signData func(eph []byte) []byte) []byte {
+	eph := ecc.GetPubKey().Bytes(true)
+	part := append([]byte{}, eph...)
+	part = append(part, identity.EccKey.PublicKey.Bytes(true)...)
+	return append(part, identity.Sign(signData(eph))...)
+}
+
+// parseUdpIdentity 解析并校验对端的临时公钥和身份签名，返回临时公钥和身份指纹
+func parseUdpIdentity(part []byte, signData func(eph []byte) []byte) (*ecies.PublicKey, string, error) {
+	if len(part) <= 2*udpPubKeySize {
+		return nil, "", ErrBadFrame
+	}
+
+	eph, err := ecies.NewPublicKeyFromBytes(part[:udpPubKeySize])
+	if nil != err {
+		return nil, "", err
+	}
+	idKey, err := ecies.NewPublicKeyFromBytes(part[udpPubKeySize : 2*udpPubKeySize])
+	if nil != err {
+		return nil, "", err
+	}
+	if !VerifySign(idKey, signData(part[:udpPubKeySize]), part[2*udpPubKeySize:]) {
+		return nil, "", ErrFrameAuthFailed
+	}
+
+	return eph, Fingerprint(idKey), nil
+}
+
+// hasIdentity ECDH握手需要的身份密钥和对端身份记录
+func (udp *UdpServer) hasIdentity() bool {
+	return nil != udp.Identity && nil != udp.Identity.EccKey && nil != udp.KnownPeers
+}
+
+// isUdpHandshake 握手请求和响应，由握手协程处理
+func isUdpHandshake(datagram []byte) bool {
+	return len(datagram) >= 2 && (datagram[0] == udpType_Hello || datagram[0] == udpType_HelloAck)
+}
+
+// handshakeLoop 处理握手数据报，接收协程退出时关闭队列
+func (udp *UdpServer) handshakeLoop(queue chan udpDatagram) {
+	for dg := range queue {
+		udp.openDatagram(dg.data, dg.raddr)
+	}
+}
+
+// queueHandshake 握手数据报交给握手协程，队列满时丢弃
+func (udp *UdpServer) queueHandshake(queue chan udpDatagram, datagram []byte, raddr *net.UDPAddr) {
+	select {
+	case queue <- udpDatagram{datagram, raddr}:
+	default:
+		udp.dropDatagram(raddr, ErrUdpBusy)
+	}
+}
+
+// udpNonce 由序号构成的GCM nonce，同一方向的序号不重复
+func udpNonce(seq []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce[12-udpSeqSize:], seq)
+	return nonce
+}
+
+// established 是否已有可用于发送的密钥
+func (s *udpSession) established() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return nil != s.cur
+}
+
+func (s *udpSession) seal(data []byte) ([]byte, error) {
+	s.lock.Lock()
+	if nil == s.cur {
+		s.lock.Unlock()
+		return nil, ErrUdpNoSession
+	}
+	s.sendSeq++
+	seq := s.sendSeq
+	key := s.cur.keys.send
+	s.lock.Unlock()
+
+	aead, err := newAead(Cipher_AesGcm, key)
+	if nil != err {
+		return nil, err
+	}
+
+	out := make([]byte, 1+udpSeqSize, 1+udpSeqSize+len(data)+aead.Overhead())
+	out[0] = udpType_Data
+	binary.BigEndian.PutUint64(out[1:], seq)
+
+	return aead.Seal(out, udpNonce(out[1:1+udpSeqSize]), data, out[:1+udpSeqSize]), nil
+}
+
+func (s *udpSession) open(datagram []byte) ([]byte, error) {
+	if len(datagram) < 1+udpSeqSize+extTagSize {
+		return nil, ErrBadFrame
+	}
+
+	head := datagram[:1+udpSeqSize]
+	nonce := udpNonce(datagram[1 : 1+udpSeqSize])
+
+	s.lock.Lock()
+	cur, prev, pending := s.cur, s.prev, s.pending
+	s.lock.Unlock()
+
+	for _, k := range []*udpKeys{cur, prev, pending} {
+		if nil == k {
+			continue
+		}
+
+		aead, err := newAead(Cipher_AesGcm, k.keys.recv)
+		if nil != err {
+			return nil, err
+		}
+
+		plain, err := aead.Open(nil, nonce, datagram[1+udpSeqSize:], head)
+		if nil != err {
+			continue
+		}
+
+		if !k.window.accept(binary.BigEndian.Uint64(datagram[1:])) {
+			return nil, ErrReplayedFrame
+		}
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		//对端已用新密钥发送，启用新密钥，旧密钥连同其接收窗口保留为prev
+		if k == s.pending {
+			if nil != s.cur {
+				s.prev = s.cur
+			}
+			s.cur, s.pending = k, nil
+		}
+		s.lastSeen = time.Now()
+
+		return plain, nil
+	}
+
+	return nil, ErrFrameAuthFailed
+}
+
+// GetDroppedCount 安全模式下丢弃的数据报数量
+func (udp *UdpServer) GetDroppedCount() uint64 {
+	return udp.dropCount.Load()
+}
+
+func (udp *UdpServer) usePsk() bool {
+	return len(udp.Psk) > 0 || nil != udp.OnGetPsk
+}
+
+// lookupPsk 响应方按密钥ID查找预共享密钥
+func (udp *UdpServer) lookupPsk(keyID string) []byte {
+	if nil != udp.OnGetPsk {
+		return udp.OnGetPsk(keyID)
+	}
+	if keyID == udp.PskID {
+		return udp.Psk
+	}
+
+	return nil
+}
+
+func (udp *UdpServer) getSession(addr string) *udpSession {
+	udp.sessLock.Lock()
+	defer udp.sessLock.Unlock()
+
+	return udp.sessions[addr]
+}
+
+// sessionFor 取对端的会话，没有时创建，调用方需持有sessLock
+func (udp *UdpServer) sessionFor(addr string) *udpSession {
+	if nil == udp.sessions {
+		udp.sessions = make(map[string]*udpSession)
+	}
+
+	s, has := udp.sessions[addr]
+	if !has {
+		if len(udp.sessions) >= udpMaxSessions {
+			udp.evictSessions()
+		}
+		s = &udpSession{lastSeen: time.Now()}
+		udp.sessions[addr] = s
+	}
+
+	return s
+}
+
+// evictSessions 会话数达到上限时清除最久未使用的一半，调用方需持有sessLock
+func (udp *UdpServer) evictSessions() {
+	type lru struct {
+		addr     string
+		lastSeen time.Time
+	}
+
+	all := make([]lru, 0, len(udp.sessions))
+	for addr, s := range udp.sessions {
+		s.lock.Lock()
+		all = append(all, lru{addr, s.lastSeen})
+		s.lock.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].lastSeen.Before(all[j].lastSeen) })
+
+	for _, old := range all[:len(all)/2+1] {
+		delete(udp.sessions, old.addr)
+	}
+}
+
+// putSession 发起方握手完成，立即启用新密钥，旧密钥保留为prev
+func (udp *UdpServer) putSession(addr string, k *udpKeys) {
+	udp.sessLock.Lock()
+	defer udp.sessLock.Unlock()
+
+	s := udp.sessionFor(addr)
+	s.lock.Lock()
+	if nil != s.cur {
+		s.prev = s.cur
+	}
+	s.cur = k
+	s.lastSeen = time.Now()
+	s.lock.Unlock()
+}
+
+// putPending 响应方握手完成，登记待启用密钥，收到用它加密的数据报后启用
+func (udp *UdpServer) putPending(addr string, k *udpKeys) {
+	udp.sessLock.Lock()
+	defer udp.sessLock.Unlock()
+
+	s := udp.sessionFor(addr)
+	s.lock.Lock()
+	s.pending = k
+	s.lock.Unlock()
+}
+
+// CloseSession 删除与对端的安全会话，之后发送数据会重新握手
+func (udp *UdpServer) CloseSession(addr *net.UDPAddr) {
+	udp.sessLock.Lock()
+	defer udp.sessLock.Unlock()
+
+	delete(udp.sessions, addr.String())
+}
+
+// Handshake 与对端建立安全会话，已有会话时直接返回
+func (udp *UdpServer) Handshake(addr *net.UDPAddr, msTimeOut int) error {
+	if s := udp.getSession(addr.String()); nil != s && s.established() {
+		return nil
+	}
+
+	hs := &udpHandshake{done: make(chan *udpKeys, 1)}
+	if udp.usePsk() {
+		nonce := make([]byte, udpNonceSize)
+		rand.Read(nonce)
+
+		hs.kex = udpKex_Psk
+		hs.psk = udp.Psk
+		hs.hello = []byte{udpType_Hello, udpKex_Psk, byte(len(udp.PskID))}
+		hs.hello = append(hs.hello, []byte(udp.PskID)...)
+		hs.hello = append(hs.hello, nonce...)
+		hs.hello = append(hs.hello, udpPskHelloMac(udp.Psk, udp.PskID, nonce)...)
+	} else {
+		if !udp.hasIdentity() {
+			return ErrUdpNoIdentity
+		}
+
+		hs.kex = udpKex_Ecdh
+		hs.ecc = &ECC{}
+		hs.hello = append([]byte{udpType_Hello, udpKex_Ecdh}, udpIdentityPart(hs.ecc, udp.Identity, udpHelloSignData)...)
+	}
+
+	key := addr.String()
+	udp.sessLock.Lock()
+	if nil == udp.handshakes {
+		udp.handshakes = make(map[string]*udpHandshake)
+	}
+	udp.handshakes[key] = hs
+	udp.sessLock.Unlock()
+
+	defer func() {
+		udp.sessLock.Lock()
+		if udp.handshakes[key] == hs {
+			delete(udp.handshakes, key)
+		}
+		udp.sessLock.Unlock()
+	}()
+
+	//UDP可能丢包，超时时间内重发3次握手请求
+	retry := time.Duration(msTimeOut) * time.Millisecond / 3
+	for i := 0; i < 3; i++ {
+		_, err := udp.conn().WriteToUDP(hs.hello, addr)
+		if nil != err {
+			return err
+		}
+
+		select {
+		case k := <-hs.done:
+			udp.putSession(key, k)
+			return nil
+		case <-time.After(retry):
+		}
+	}
+
+	return ErrUdpHandshakeTimeout
+}
+
+// sendSecure 加密发送，没有会话时先握手
+func (udp *UdpServer) sendSecure(data []byte, addr *net.UDPAddr) (int, error) {
+	err := udp.Handshake(addr, 3000)
+	if nil != err {
+		return 0, err
+	}
+
+	s := udp.getSession(addr.String())
+	if nil == s {
+		return 0, ErrUdpNoSession
+	}
+
+	datagram, err := s.seal(data)
+	if nil != err {
+		return 0, err
+	}
+
+	_, err = udp.conn().WriteToUDP(datagram, addr)
+	if nil != err {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// openDatagram 处理安全模式下收到的数据报，返回解密后的用户数据；握手和无效数据报返回nil
+func (udp *UdpServer) openDatagram(datagram []byte, raddr *net.UDPAddr) []byte {
+	if len(datagram) < 2 {
+		udp.dropDatagram(raddr, ErrBadFrame)
+		return nil
+	}
+
+	switch datagram[0] {
+	case udpType_Hello:
+		udp.onUdpHello(datagram, raddr)
+	case udpType_HelloAck:
+		udp.onUdpHelloAck(datagram, raddr)
+	case udpType_Data:
+		s := udp.getSession(raddr.String())
+		if nil == s {
+			udp.dropDatagram(raddr, ErrUdpNoSession)
+			return nil
+		}
+
+		plain, err := s.open(datagram)
+		if nil != err {
+			udp.dropDatagram(raddr, err)
+			return nil
+		}
+
+		return plain
+	default:
+		udp.dropDatagram(raddr, ErrBadFrame)
+	}
+
+	return nil
+}
+
+func (udp *UdpServer) dropDatagram(raddr *net.UDPAddr, err error) {
+	udp.dropCount.Add(1)
+	fmt.Println("UdpServer 丢弃数据报", raddr, err)
+}
+
+// onUdpHello 响应方处理握手请求
+func (udp *UdpServer) onUdpHello(hello []byte, raddr *net.UDPAddr) {
+	var ack []byte
+	var k *udpKeys
+
+	switch hello[1] {
+	case udpKex_Psk:
+		if !udp.usePsk() || len(hello) < 3 {
+			udp.dropDatagram(raddr, ErrBadFrame)
+			return
+		}
+
+		idLen := int(hello[2])
+		if len(hello) != 3+idLen+udpNonceSize+udpMacSize {
+			udp.dropDatagram(raddr, ErrBadFrame)
+			return
+		}
+		keyID := string(hello[3 : 3+idLen])
+		nonce := hello[3+idLen : 3+idLen+udpNonceSize]
+		mac := hello[3+idLen+udpNonceSize:]
+
+		psk := udp.lookupPsk(keyID)
+		if len(psk) <= 0 || !hmac.Equal(mac, udpPskHelloMac(psk, keyID, nonce)) {
+			udp.dropDatagram(raddr, ErrFrameAuthFailed)
+			return
+		}
+
+		nonceR := make([]byte, udpNonceSize)
+		rand.Read(nonceR)
+		transcript := transcriptHash(string(hello), string(nonceR))
+
+		ack = append([]byte{udpType_HelloAck, udpKex_Psk}, nonceR...)
+		ack = append(ack, udpFinishedMac(psk, transcript)...)
+		k = newUdpKeys(psk, transcript, true)
+	case udpKex_Ecdh:
+		if udp.usePsk() || !udp.hasIdentity() {
+			udp.dropDatagram(raddr, ErrUdpNoIdentity)
+			return
+		}
+
+		//来源地址可以伪造，只按身份指纹校验，不记录新的对端
+		pubKey, fp, err := parseUdpIdentity(hello[2:], udpHelloSignData)
+		if nil == err && !udp.KnownPeers.HasFingerprint(fp) {
+			err = ErrUdpPeerUnknown
+		}
+		if nil != err {
+			udp.dropDatagram(raddr, err)
+			return
+		}
+
+		ecc := &ECC{}
+		ecc.initKey()
+		secret, err := ecc.EccKey.ECDH(pubKey)
+		if nil != err {
+			udp.dropDatagram(raddr, err)
+			return
+		}
+
+		signData := func(eph []byte) []byte { return udpAckSignData(hello, eph) }
+		ack = append([]byte{udpType_HelloAck, udpKex_Ecdh}, udpIdentityPart(ecc, udp.Identity, signData)...)
+		k = newUdpKeys(secret, transcriptHash(string(hello), string(ack)), true)
+	default:
+		udp.dropDatagram(raddr, ErrBadFrame)
+		return
+	}
+
+	udp.putPending(raddr.String(), k)
+	udp.conn().WriteToUDP(ack, raddr)
+}
+
+// onUdpHelloAck 发起方处理握手响应
+func (udp *UdpServer) onUdpHelloAck(ack []byte, raddr *net.UDPAddr) {
+	udp.sessLock.Lock()
+	hs := udp.handshakes[raddr.String()]
+	udp.sessLock.Unlock()
+
+	if nil == hs || ack[1] != hs.kex {
+		udp.dropDatagram(raddr, ErrBadFrame)
+		return
+	}
+
+	var k *udpKeys
+	switch hs.kex {
+	case udpKex_Psk:
+		if len(ack) != 2+udpNonceSize+udpMacSize {
+			udp.dropDatagram(raddr, ErrBadFrame)
+			return
+		}
+
+		transcript := transcriptHash(string(hs.hello), string(ack[2:2+udpNonceSize]))
+		if !hmac.Equal(ack[2+udpNonceSize:], udpFinishedMac(hs.psk, transcript)) {
+			udp.dropDatagram(raddr, ErrFrameAuthFailed)
+			return
+		}
+		k = newUdpKeys(hs.psk, transcript, false)
+	case udpKex_Ecdh:
+		signData := func(eph []byte) []byte { return udpAckSignData(hs.hello, eph) }
+		pubKey, fp, err := parseUdpIdentity(ack[2:], signData)
+		if nil == err {
+			err = udp.KnownPeers.Check(raddr.String(), fp)
+		}
+		if nil != err {
+			udp.dropDatagram(raddr, err)
+			return
+		}
+
+		secret, err := hs.ecc.EccKey.ECDH(pubKey)
+		if nil != err {
+			udp.dropDatagram(raddr, err)
+			return
+		}
+		k = newUdpKeys(secret, transcriptHash(string(hs.hello), string(ack)), false)
+	}
+
+	select {
+	case hs.done <- k:
+	default:
+	}
+}
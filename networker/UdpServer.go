@@ -2,14 +2,16 @@ package networker
 
 import (
 	"container/list"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type UdpServer struct {
-	lsener         *net.UDPConn
+	lsener         atomic.Pointer[net.UDPConn] //Stop时置空，接收协程据此退出
 	readLock       sync.Mutex
 	OnDataReceived func(svr *UdpServer, pac *UdpPackage)
 
@@ -17,10 +19,40 @@ type UdpServer struct {
 	workerLock  sync.Mutex
 	pacQueue    *list.List
 	readPacChan chan bool
+
+	//安全模式：与对端握手建立会话密钥后加密并认证每个数据报，丢弃其他数据报
+	//设置了预共享密钥（Psk或OnGetPsk）时使用PSK握手，否则使用ECDH
+	Secure   bool
+	PskID    string
+	Psk      []byte
+	OnGetPsk func(keyID string) []byte //响应方按密钥ID查找预共享密钥，为空时只接受PskID
+	//ECDH握手时必须设置：本端身份密钥（用 LoadOrCreateECC 加载），以及对端身份记录；
+	//主动握手时按目标地址首次信任，接受对端握手时只接受已登记的指纹（KnownServers.Add 或首次信任记录）
+	Identity   *ECC
+	KnownPeers *KnownServers
+
+	sessLock   sync.Mutex
+	sessions   map[string]*udpSession
+	handshakes map[string]*udpHandshake
+	dropCount  atomic.Uint64
 }
 
 func (udp *UdpServer) IsListening() bool {
-	return nil != udp.lsener
+	return nil != udp.lsener.Load()
+}
+
+// Addr 监听地址，未启动时返回nil；Start(0)时用于获取系统分配的端口
+func (udp *UdpServer) Addr() *net.UDPAddr {
+	lsener := udp.lsener.Load()
+	if nil == lsener {
+		return nil
+	}
+
+	return lsener.LocalAddr().(*net.UDPAddr)
+}
+
+func (udp *UdpServer) conn() *net.UDPConn {
+	return udp.lsener.Load()
 }
 
 func (udp *UdpServer) Start(port int) bool {
@@ -35,49 +67,56 @@ func (udp *UdpServer) Start(port int) bool {
 		return false
 	}
 
-	udp.lsener = lsener
+	udp.lsener.Store(lsener)
 
 	udp.readPacChan = make(chan bool, 10)
-	go udp.readDataLoop()
+	go udp.readDataLoop(lsener)
 
 	return true
 }
 
 func (udp *UdpServer) Stop() {
-	if nil == udp.lsener {
+	lsener := udp.lsener.Swap(nil)
+	if nil == lsener {
 		return
 	}
 
-	err := (*udp.lsener).Close()
+	err := lsener.Close()
 	if nil != err {
-		fmt.Println("停止监听失败 Addr=", (*udp.lsener).LocalAddr().String(), err)
+		fmt.Println("停止监听失败 Addr=", lsener.LocalAddr().String(), err)
 	}
 
-	udp.lsener = nil
+	udp.sessLock.Lock()
+	udp.sessions = nil
+	udp.sessLock.Unlock()
 
 	udp.readPacChan <- true
 }
 
-func (udp *UdpServer) readDataLoop() {
+func (udp *UdpServer) readDataLoop(lsener *net.UDPConn) {
 	var buf []byte
 
-	defer func() {
-		udp.readLock.Unlock()
-	}()
-
-	if nil == udp.lsener {
-		return
-	}
-
 	if !udp.readLock.TryLock() {
 		return
 	}
+	defer udp.readLock.Unlock()
+
+	//握手的签名、ECDH和保存记录较慢，在单独的协程中处理
+	var hsQueue chan udpDatagram
+	if udp.Secure {
+		hsQueue = make(chan udpDatagram, udpHandshakeQueue)
+		go udp.handshakeLoop(hsQueue)
+		defer close(hsQueue)
+	}
 
 	buf = make([]byte, 1024*64) //UDP包最大64K
 
-	for nil != udp.lsener {
-		dataLen, raddr, err := (*udp.lsener).ReadFromUDP(buf)
+	for lsener == udp.lsener.Load() {
+		dataLen, raddr, err := lsener.ReadFromUDP(buf)
 		if nil != err {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println("读取数据异常", err)
 			continue
 		}
@@ -91,6 +130,19 @@ func (udp *UdpServer) readDataLoop() {
 		copy(pac.Data, buf)
 		pac.SetIPv4Addr(raddr)
 
+		//安全模式下只把解密认证通过的数据交给调用方
+		if udp.Secure {
+			if isUdpHandshake(pac.Data) {
+				udp.queueHandshake(hsQueue, pac.Data, raddr)
+				continue
+			}
+
+			pac.Data = udp.openDatagram(pac.Data, raddr)
+			if nil == pac.Data {
+				continue
+			}
+		}
+
 		//非回复包放入队列
 		pacCount := 0
 		//入队列
@@ -125,15 +177,17 @@ func (udp *UdpServer) invokePackageWorker() {
 	}
 
 	for {
-		if udp.pacQueue.Len() <= 0 {
-			break
-		}
-
 		udp.queLock.Lock()
 		el := udp.pacQueue.Front()
-		udp.pacQueue.Remove(el)
+		if nil != el {
+			udp.pacQueue.Remove(el)
+		}
 		udp.queLock.Unlock()
 
+		if nil == el {
+			break
+		}
+
 		pac := el.Value.(*UdpPackage)
 
 		if nil != udp.OnDataReceived {
@@ -143,23 +197,32 @@ func (udp *UdpServer) invokePackageWorker() {
 
 	udp.workerLock.Unlock()
 
-	if udp.pacQueue.Len() > 0 {
+	udp.queLock.Lock()
+	pending := udp.pacQueue.Len() > 0
+	udp.queLock.Unlock()
+
+	if pending {
 		go udp.invokePackageWorker()
 	}
 }
 
 func (udp *UdpServer) Send(data []byte, addr *net.UDPAddr) (int, error) {
-	if nil == udp.lsener {
+	lsener := udp.lsener.Load()
+	if nil == lsener {
 		return 0, net.ErrClosed
 	}
 
-	return udp.lsener.WriteToUDP(data, addr)
+	if udp.Secure {
+		return udp.sendSecure(data, addr)
+	}
+
+	return lsener.WriteToUDP(data, addr)
 }
 
 func (udp *UdpServer) JavaSend(data []byte, ip int, port int) int {
 	addr := ToIPv4(ip, port)
 
-	lenSended, err := udp.lsener.WriteToUDP(data, addr)
+	lenSended, err := udp.Send(data, addr)
 	if nil != err {
 		fmt.Println("UdpServer.JavaSend 失败", err)
 		return 0
@@ -206,6 +269,10 @@ func (udp *UdpServer) readPackage(msTimeOut int) *UdpPackage {
 }
 
 func (udp *UdpServer) Broadcast(data []byte, port int) int {
+	if udp.Secure {
+		fmt.Println("UdpServer.Broadcast 安全模式不支持广播")
+		return 0
+	}
 
 	ips := GetLocalIPv4()
 	if nil == ips || len(ips) <= 0 {
@@ -0,0 +1,126 @@
+package networker
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testUdpServer 在本机随机端口启动安全模式的UDP服务，收到的数据写入got
+func testUdpServer(t *testing.T, cfg func(udp *UdpServer), got chan string) (*UdpServer, *net.UDPAddr) {
+	udp := &UdpServer{Secure: true}
+	if nil != cfg {
+		cfg(udp)
+	}
+	udp.OnDataReceived = func(svr *UdpServer, pac *UdpPackage) {
+		got <- string(pac.Data)
+	}
+
+	if !udp.Start(0) {
+		t.Fatal("启动UDP服务失败")
+	}
+	t.Cleanup(udp.Stop)
+
+	return udp, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.Addr().Port}
+}
+
+func testUdpIdentity(t *testing.T, name string) func(udp *UdpServer) {
+	return func(udp *UdpServer) {
+		ecc, err := LoadOrCreateECC(filepath.Join(t.TempDir(), name+".pem"))
+		if nil != err {
+			t.Fatal(err)
+		}
+		udp.Identity = ecc
+		udp.KnownPeers = NewKnownServers("")
+	}
+}
+
+func testUdpRecv(t *testing.T, got chan string, want string) {
+	select {
+	case data := <-got:
+		if data != want {
+			t.Fatal("收到", data, "期望", want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("没有收到", want)
+	}
+}
+
+func TestUdpSecureEcdh(t *testing.T) {
+	got := make(chan string, 4)
+	a, addrA := testUdpServer(t, testUdpIdentity(t, "a"), got)
+	b, addrB := testUdpServer(t, testUdpIdentity(t, "b"), got)
+
+	//响应方只接受预先登记的身份，与来源地址无关
+	if err := b.KnownPeers.Add("a", Fingerprint(a.Identity.EccKey.PublicKey)); nil != err {
+		t.Fatal(err)
+	}
+
+	if _, err := a.Send([]byte("hello"), addrB); nil != err {
+		t.Fatal("发送失败", err)
+	}
+	testUdpRecv(t, got, "hello")
+	if _, err := b.Send([]byte("reply"), addrA); nil != err {
+		t.Fatal("回复失败", err)
+	}
+	testUdpRecv(t, got, "reply")
+
+	//发起方按目标地址记录响应方身份
+	if fp, has := a.KnownPeers.Get(addrB.String()); !has || fp != Fingerprint(b.Identity.EccKey.PublicKey) {
+		t.Fatal("没有记录响应方身份", fp)
+	}
+
+	//未登记的发起方握手失败，响应方不记录其身份
+	c, addrC := testUdpServer(t, testUdpIdentity(t, "c"), got)
+	if err := c.Handshake(addrB, 300); err != ErrUdpHandshakeTimeout {
+		t.Fatal("应返回 ErrUdpHandshakeTimeout", err)
+	}
+	if b.KnownPeers.HasFingerprint(Fingerprint(c.Identity.EccKey.PublicKey)) {
+		t.Fatal("响应方记录了未登记的身份")
+	}
+	if _, has := b.KnownPeers.Get(addrC.String()); has {
+		t.Fatal("响应方按来源地址记录了身份")
+	}
+}
+
+func TestUdpSecurePsk(t *testing.T) {
+	got := make(chan string, 4)
+	a, _ := testUdpServer(t, func(udp *UdpServer) {
+		udp.PskID, udp.Psk = "u", []byte("udp-secret")
+	}, got)
+	_, addrB := testUdpServer(t, func(udp *UdpServer) {
+		udp.OnGetPsk = func(keyID string) []byte {
+			if keyID == "u" {
+				return []byte("udp-secret")
+			}
+			return nil
+		}
+	}, got)
+
+	if _, err := a.Send([]byte("hello"), addrB); nil != err {
+		t.Fatal("发送失败", err)
+	}
+	testUdpRecv(t, got, "hello")
+
+	//密钥不同时握手失败
+	wrong, _ := testUdpServer(t, func(udp *UdpServer) {
+		udp.PskID, udp.Psk = "u", []byte("other")
+	}, got)
+	if err := wrong.Handshake(addrB, 300); err != ErrUdpHandshakeTimeout {
+		t.Fatal("应返回 ErrUdpHandshakeTimeout", err)
+	}
+}
+
+func TestUdpHandshakeQueue(t *testing.T) {
+	udp := &UdpServer{Secure: true}
+	raddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	//握手协程处理不及时时丢弃，不阻塞接收
+	queue := make(chan udpDatagram, 1)
+	udp.queueHandshake(queue, []byte{udpType_Hello, udpKex_Ecdh}, raddr)
+	udp.queueHandshake(queue, []byte{udpType_Hello, udpKex_Ecdh}, raddr)
+	if len(queue) != 1 || udp.GetDroppedCount() != 1 {
+		t.Fatal("握手队列满时没有丢弃", len(queue), udp.GetDroppedCount())
+	}
+}
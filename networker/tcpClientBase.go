@@ -27,34 +27,51 @@ SOFTWARE.
 package networker
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type tcpClientBase struct {
-	conn *net.Conn
+	conn       atomic.Pointer[net.Conn] //关闭时置空，收发协程和Close并发访问
+	remoteAddr string                   //Connect时指定的服务端地址，服务端连接为客户端地址
 
 	ClientFlag string
+	TLSConfig  *tls.Config //设置后Connect使用TLS连接，ServerName为空时使用服务端地址
 
 	// reader *bufio.Reader
 	User            *LoginUserInfo
-	lastSendTime    time.Time
-	lastReceiveTime time.Time
+	lastSendTime    atomic.Int64 //最近一次发送的时间（UnixNano），多个协程同时发送
+	lastReceiveTime atomic.Int64 //最近一次收到数据的时间（UnixNano）
 
 	OnClosed func()
 }
 
 func (tcp *tcpClientBase) IsConnected() bool {
-	return nil != tcp.conn
+	return nil != tcp.conn.Load()
 }
 
 func (tcp *tcpClientBase) GetLastReceiveTime() time.Time {
-	return tcp.lastReceiveTime
+	return unixNanoTime(tcp.lastReceiveTime.Load())
+}
+
+// GetLastSendTime 最近一次发送成功的时间，没有发送过时为零值
+func (tcp *tcpClientBase) GetLastSendTime() time.Time {
+	return unixNanoTime(tcp.lastSendTime.Load())
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if 0 == ns {
+		return time.Time{}
+	}
+
+	return time.Unix(0, ns)
 }
 
 func (tcp *tcpClientBase) onClosedHandler() {
@@ -70,36 +87,64 @@ func (tcp *tcpClientBase) onClosedHandler() {
 // }
 
 func (tcp *tcpClientBase) GetConn() *net.Conn {
-	return tcp.conn
+	return tcp.conn.Load()
+}
+
+// GetTLSState TLS连接的状态（对端证书等），非TLS连接返回false
+func (tcp *tcpClientBase) GetTLSState() (tls.ConnectionState, bool) {
+	conn := tcp.conn.Load()
+	if nil == conn {
+		return tls.ConnectionState{}, false
+	}
+
+	tlsConn, ok := (*conn).(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+
+	return tlsConn.ConnectionState(), true
 }
 
 func (tcp *tcpClientBase) Connect(svr string, port int, msWait int) bool {
-	if nil != tcp.conn /*&& nil != tcp.reader*/ {
+	if nil != tcp.conn.Load() /*&& nil != tcp.reader*/ {
 		return true
 	}
 
-	conn, err := net.DialTimeout("tcp", svr+":"+strconv.Itoa(port), time.Duration(int64(msWait)*int64(time.Millisecond)))
+	var conn net.Conn
+	var err error
+	timeout := time.Duration(int64(msWait) * int64(time.Millisecond))
+	if nil != tcp.TLSConfig {
+		cfg := tcp.TLSConfig
+		if len(cfg.ServerName) <= 0 && !cfg.InsecureSkipVerify {
+			cfg = cfg.Clone()
+			cfg.ServerName = svr
+		}
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", svr+":"+strconv.Itoa(port), cfg)
+	} else {
+		conn, err = net.DialTimeout("tcp", svr+":"+strconv.Itoa(port), timeout)
+	}
 	if nil != err {
 		fmt.Println("连接失败", svr, port, err)
 		return false
 	}
 
-	tcp.conn = &conn
+	tcp.remoteAddr = svr + ":" + strconv.Itoa(port)
+	tcp.lastReceiveTime.Store(time.Now().UnixNano())
+	tcp.conn.Store(&conn)
 	// tcp.reader = bufio.NewReader(conn)
 	// tcp.reader.Discard(tcp.reader.Buffered())
 
-	tcp.lastReceiveTime = time.Now()
-
 	return true
 }
 
 func (tcp *tcpClientBase) Close() {
-	if nil == tcp.conn {
+	//多个协程同时关闭时只有一个执行关闭和回调
+	conn := tcp.conn.Swap(nil)
+	if nil == conn {
 		return
 	}
 
-	(*tcp.conn).Close()
-	tcp.conn = nil
+	(*conn).Close()
 	// tcp.reader = nil
 
 	tcp.onClosedHandler()
@@ -110,11 +155,12 @@ func (tcp *tcpClientBase) Write(data []byte) int {
 }
 
 func (tcp *tcpClientBase) WriteWithTimeOut(data []byte, msWait int) int {
-	if nil == tcp.conn || nil == data {
+	pconn := tcp.conn.Load()
+	if nil == pconn || nil == data {
 		return 0
 	}
 
-	conn := *tcp.conn
+	conn := *pconn
 	if msWait > 0 {
 		err := conn.SetWriteDeadline(time.Now().Add(time.Duration(int64(msWait) * int64(time.Millisecond))))
 		if nil != err {
@@ -144,7 +190,7 @@ func (tcp *tcpClientBase) WriteWithTimeOut(data []byte, msWait int) int {
 		totalSend += count
 	}
 
-	tcp.lastSendTime = time.Now()
+	tcp.lastSendTime.Store(time.Now().UnixNano())
 
 	return totalSend
 }
@@ -154,10 +200,11 @@ func (tcp *tcpClientBase) ReadData(dataLen uint32, buf []byte) error {
 }
 
 func (tcp *tcpClientBase) ReadDataWithTimeOut(dataLen uint32, buf []byte, msWait int) error {
-	if nil == tcp.conn {
+	pconn := tcp.conn.Load()
+	if nil == pconn {
 		return nil
 	}
-	con := *tcp.conn
+	con := *pconn
 
 	var err error
 	var count int
@@ -181,7 +228,7 @@ func (tcp *tcpClientBase) ReadDataWithTimeOut(dataLen uint32, buf []byte, msWait
 			// fmt.Println("tcpClientBase.readDataWithTimeOut err ", err)
 			break
 		}
-		tcp.lastReceiveTime = time.Now()
+		tcp.lastReceiveTime.Store(time.Now().UnixNano())
 		totalRead += uint32(count)
 	}
 	// fmt.Println("tcpClientBase.readDataWithTimeOut for end")
@@ -190,10 +237,11 @@ func (tcp *tcpClientBase) ReadDataWithTimeOut(dataLen uint32, buf []byte, msWait
 }
 
 func (tcp *tcpClientBase) ReadLineWithTimeOut(msWait int) (string, error) {
-	if nil == tcp.conn {
+	pconn := tcp.conn.Load()
+	if nil == pconn {
 		return "", net.ErrClosed
 	}
-	con := *tcp.conn
+	con := *pconn
 
 	var err error
 	var count int
@@ -219,7 +267,7 @@ func (tcp *tcpClientBase) ReadLineWithTimeOut(msWait int) (string, error) {
 			// fmt.Println("tcpClientBase.readDataWithTimeOut err ", err)
 			break
 		}
-		tcp.lastReceiveTime = time.Now()
+		tcp.lastReceiveTime.Store(time.Now().UnixNano())
 		totalRead += uint32(count)
 
 		if buf[totalRead-1] == '\n' {